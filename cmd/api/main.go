@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	"flag"
 	"fmt"
@@ -14,19 +15,26 @@ import (
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 
+	"github.com/AguilaMike/greenlight/internal/auth"
+	"github.com/AguilaMike/greenlight/internal/breached"
+	"github.com/AguilaMike/greenlight/internal/clientip"
 	"github.com/AguilaMike/greenlight/internal/config"
 	"github.com/AguilaMike/greenlight/internal/data"
 	"github.com/AguilaMike/greenlight/internal/database"
 	"github.com/AguilaMike/greenlight/internal/mailer"
+	"github.com/AguilaMike/greenlight/internal/metrics"
+	"github.com/AguilaMike/greenlight/internal/ratelimit"
 	"github.com/AguilaMike/greenlight/internal/server"
+	"github.com/AguilaMike/greenlight/internal/tracing"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
 )
 
 func main() {
 	// Initialize a new structured logger which writes log entries to the standard out
-	// stream.
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// stream, adding the request ID and user ID to the entries logged for a request.
+	logger := slog.New(helper.NewLogHandler(slog.NewTextHandler(os.Stdout, nil)))
 
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
@@ -46,6 +54,30 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Set up the OpenTelemetry tracing, and make sure that any pending spans are
+	// flushed before the application exits.
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:       cfg.Tracing.Exporter,
+		OTLPEndpoint:   cfg.Tracing.OTLPEndpoint,
+		OTLPInsecure:   cfg.Tracing.OTLPInsecure,
+		SampleRatio:    cfg.Tracing.SampleRatio,
+		ServiceVersion: config.VERSION,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := shutdownTracing(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
@@ -98,21 +130,178 @@ func main() {
 		return db.Stats()
 	}))
 
+	// Expose the database connection pool statistics in the Prometheus metrics too.
+	metrics.RegisterDB(db)
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	// If the signed token mode is enabled, load the signing keys. Otherwise the signer
+	// is left as nil and every authentication token is looked up in the database.
+	var signer *auth.Signer
+	switch cfg.Auth.TokenMode {
+	case auth.ModeStateful:
+	case auth.ModeSigned:
+		if cfg.Auth.AccessTokenTTL > auth.MaxSignedAccessTokenTTL {
+			logger.Error(fmt.Sprintf("access token ttl must not be more than %s in the signed token mode", auth.MaxSignedAccessTokenTTL))
+			os.Exit(1)
+		}
+
+		signer, err = auth.NewSigner("greenlight", cfg.Auth.SigningKeys)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error(fmt.Sprintf("invalid token mode: %s", cfg.Auth.TokenMode))
+		os.Exit(1)
+	}
+
+	// Two-factor authentication is only available when an encryption key has been
+	// configured, as we never store the TOTP secrets in plaintext.
+	var cipher *auth.Cipher
+	if cfg.Auth.EncryptionKey != "" {
+		cipher, err = auth.NewCipher(cfg.Auth.EncryptionKey)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// If an OIDC issuer has been configured, fetch its discovery document so that users
+	// can sign in with the identity provider.
+	var oidcProvider *auth.OIDCProvider
+	if cfg.OIDC.Issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		oidcProvider, err = auth.NewOIDCProvider(ctx, cfg.OIDC.Name, cfg.OIDC.Issuer, cfg.OIDC.ClientID, cfg.OIDC.ClientSecret, cfg.OIDC.RedirectURL, cfg.OIDC.Scopes)
+		cancel()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("oidc provider configured", "issuer", cfg.OIDC.Issuer)
+	}
+
+	// Set the algorithm and parameters used to hash new passwords.
+	err = data.SetPasswordHashing(data.PasswordHashing{
+		Algorithm:     cfg.Password.HashAlgorithm,
+		BcryptCost:    cfg.Password.BcryptCost,
+		Argon2Time:    cfg.Password.Argon2Time,
+		Argon2Memory:  cfg.Password.Argon2Memory,
+		Argon2Threads: cfg.Password.Argon2Threads,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Build the password policy, loading the breached password corpus if one has been
+	// configured.
+	passwordPolicy := &data.PasswordPolicy{
+		MinLength:        cfg.Password.MinLength,
+		RequireUpper:     cfg.Password.RequireUpper,
+		RequireLower:     cfg.Password.RequireLower,
+		RequireDigit:     cfg.Password.RequireDigit,
+		RequireSymbol:    cfg.Password.RequireSymbol,
+		DisallowPersonal: cfg.Password.DisallowPersonal,
+	}
+
+	if cfg.Password.BreachedFile != "" {
+		passwordPolicy.Breached, err = breached.Load(cfg.Password.BreachedFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("breached password corpus loaded", "hashes", passwordPolicy.Breached.Len())
+	}
+
+	// Create the resolver for client IP addresses, which only trusts the forwarded
+	// headers set by the configured proxies.
+	ipResolver, err := clientip.NewResolver(cfg.Proxy.TrustedProxies, cfg.Proxy.Header)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Create the rate limiter store. The in-memory store is only suitable for a single
+	// instance, so deployments with several replicas should share a Redis store instead.
+	var rateLimiter ratelimit.Store
+	switch cfg.Limiter.Store {
+	case "memory":
+		rateLimiter = ratelimit.NewMemoryStore()
+	case "redis":
+		opts, err := redis.ParseURL(cfg.Limiter.RedisURL)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		redisClient := redis.NewClient(opts)
+		defer redisClient.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = redisClient.Ping(ctx).Err()
+		cancel()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		rateLimiter = ratelimit.NewRedisStore(redisClient, "greenlight:ratelimit:")
+
+		logger.Info("redis rate limiter store connected")
+	default:
+		logger.Error(fmt.Sprintf("invalid rate limiter store: %s", cfg.Limiter.Store))
+		os.Exit(1)
+	}
+
+	if cfg.Limiter.KeyBy != "user" && cfg.Limiter.KeyBy != "ip" {
+		logger.Error(fmt.Sprintf("invalid rate limiter key: %s", cfg.Limiter.KeyBy))
+		os.Exit(1)
+	}
+
+	// Check that every limit can be enforced, as a rate of 0 would otherwise break the
+	// rate limiter on the first request.
+	if cfg.Limiter.Enabled {
+		limits := []struct {
+			name  string
+			limit ratelimit.Limit
+		}{
+			{"default", ratelimit.Limit{Rate: cfg.Limiter.Rps, Burst: cfg.Limiter.Burst}},
+			{"read", ratelimit.Limit{Rate: cfg.Limiter.ReadRps, Burst: cfg.Limiter.ReadBurst}},
+			{"auth", ratelimit.Limit{Rate: cfg.Limiter.AuthRps, Burst: cfg.Limiter.AuthBurst}},
+			{"ip", ratelimit.Limit{Rate: cfg.Limiter.IPRps, Burst: cfg.Limiter.IPBurst}},
+		}
+
+		for _, l := range limits {
+			err := l.limit.Validate()
+			if err != nil {
+				logger.Error(fmt.Sprintf("invalid %s rate limit: %s", l.name, err))
+				os.Exit(1)
+			}
+		}
+	}
+
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &config.Application{
-		Config: cfg,
-		Logger: logger,
-		Errors: helper.NewAppErrors(logger, cfg.Env.String()),
-		Worker: helper.NewAppWorker(logger, cfg.Env.String(), wg),
-		Models: data.NewModels(db),
-		Mailer: mailer.New(cfg.Smtp.Host, cfg.Smtp.Port, cfg.Smtp.Username, cfg.Smtp.Password, cfg.Smtp.Sender),
-		Wg:     wg,
+		Config:         cfg,
+		Logger:         logger,
+		Errors:         helper.NewAppErrors(logger, cfg.Env.String()),
+		Worker:         helper.NewAppWorker(logger, cfg.Env.String(), wg),
+		Models:         data.NewModels(db),
+		Mailer:         mailer.New(cfg.Smtp.Host, cfg.Smtp.Port, cfg.Smtp.Username, cfg.Smtp.Password, cfg.Smtp.Sender),
+		Signer:         signer,
+		Cipher:         cipher,
+		OIDC:           oidcProvider,
+		PasswordPolicy: passwordPolicy,
+		RateLimiter:    rateLimiter,
+		IPResolver:     ipResolver,
+		Wg:             wg,
 	}
 
 	// Call app.serve() to start the server.
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// Define a Cipher struct which encrypts small secrets (like TOTP secrets) before they
+// are stored in the database, using AES-256 in GCM mode.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher() creates a new Cipher from a base64-encoded 32-byte key.
+func NewCipher(encodedKey string) (*Cipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New("encryption key must be base64-encoded")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt() encrypts the plaintext with a random nonce, which is prepended to the
+// returned ciphertext.
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt() reverses Encrypt(), returning an error if the ciphertext has been tampered
+// with or was encrypted with a different key.
+func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	return c.aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// stubIdP is a minimal OpenID Connect identity provider, serving the discovery document,
+// the signing keys and a token endpoint which issues an ID token with the given claims
+// for the authorization code "valid-code".
+type stubIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	claims    map[string]any
+	challenge string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &stubIdP{key: key}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		// Check the authorization code and the PKCE code verifier, like a real provider.
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+		if r.PostFormValue("code") != "valid-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(t, w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		writeJSON(t, w, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, idp.claims),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// The sign() method returns the claims as a signed JWT.
+func (idp *stubIdP) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: idp.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	const (
+		clientID     = "greenlight"
+		nonce        = "the-nonce"
+		codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	)
+
+	tests := []struct {
+		name         string
+		claims       func(issuer string) map[string]any
+		code         string
+		codeVerifier string
+		want         *Identity
+		wantErr      bool
+	}{
+		{
+			name:         "Valid",
+			claims:       func(issuer string) map[string]any { return validClaims(issuer, clientID, nonce) },
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			want: &Identity{
+				Provider:      "stub",
+				Subject:       "user-123",
+				Email:         "alice@example.com",
+				EmailVerified: true,
+				Name:          "Alice",
+			},
+		},
+		{
+			name: "Unverified email",
+			claims: func(issuer string) map[string]any {
+				claims := validClaims(issuer, clientID, nonce)
+				claims["email_verified"] = false
+				return claims
+			},
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			want: &Identity{
+				Provider: "stub",
+				Subject:  "user-123",
+				Email:    "alice@example.com",
+				Name:     "Alice",
+			},
+		},
+		{
+			name: "Nonce mismatch",
+			claims: func(issuer string) map[string]any {
+				claims := validClaims(issuer, clientID, nonce)
+				claims["nonce"] = "another-nonce"
+				return claims
+			},
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			wantErr:      true,
+		},
+		{
+			name: "Wrong audience",
+			claims: func(issuer string) map[string]any {
+				claims := validClaims(issuer, clientID, nonce)
+				claims["aud"] = "another-client"
+				return claims
+			},
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			wantErr:      true,
+		},
+		{
+			name: "Wrong issuer",
+			claims: func(issuer string) map[string]any {
+				return validClaims("https://idp.example.com", clientID, nonce)
+			},
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			wantErr:      true,
+		},
+		{
+			name: "Expired",
+			claims: func(issuer string) map[string]any {
+				claims := validClaims(issuer, clientID, nonce)
+				claims["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return claims
+			},
+			code:         "valid-code",
+			codeVerifier: codeVerifier,
+			wantErr:      true,
+		},
+		{
+			name:         "Invalid code",
+			claims:       func(issuer string) map[string]any { return validClaims(issuer, clientID, nonce) },
+			code:         "invalid-code",
+			codeVerifier: codeVerifier,
+			wantErr:      true,
+		},
+		{
+			name:         "Wrong code verifier",
+			claims:       func(issuer string) map[string]any { return validClaims(issuer, clientID, nonce) },
+			code:         "valid-code",
+			codeVerifier: "another-code-verifier-which-is-long-enough-000",
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			idp := newStubIdP(t)
+			idp.claims = tt.claims(idp.server.URL)
+
+			provider, err := NewOIDCProvider(ctx, "stub", idp.server.URL, clientID, "secret", "http://localhost:4000/v1/oidc/callback", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The provider learns the PKCE challenge from the authorization URL, which the
+			// user's browser would take there.
+			authURL, err := url.Parse(provider.AuthCodeURL("the-state", nonce, codeVerifier))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := authURL.Query().Get("code_challenge_method"); got != "S256" {
+				t.Fatalf("code_challenge_method = %q; want S256", got)
+			}
+			idp.challenge = authURL.Query().Get("code_challenge")
+
+			identity, err := provider.Exchange(ctx, tt.code, nonce, tt.codeVerifier)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Exchange() = %+v; want an error", identity)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+
+			if *identity != *tt.want {
+				t.Errorf("Exchange() = %+v; want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+// The validClaims() helper returns the claims of a valid ID token.
+func validClaims(issuer, audience, nonce string) map[string]any {
+	return map[string]any{
+		"iss":            issuer,
+		"sub":            "user-123",
+		"aud":            audience,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
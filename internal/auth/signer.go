@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/AguilaMike/greenlight/internal/data"
+)
+
+// Define the token modes supported by the application. In the stateful mode every
+// authentication token is looked up in the tokens table, while in the signed mode the
+// access tokens are self-contained JWTs which are verified locally.
+const (
+	ModeStateful = "stateful"
+	ModeSigned   = "signed"
+)
+
+// Define the longest lifetime allowed for signed access tokens. They can't be revoked
+// before they expire, so logging out, revoking all sessions, resetting the password or
+// changing the user's roles only takes full effect once they have.
+const MaxSignedAccessTokenTTL = 15 * time.Minute
+
+// Define a custom ErrInvalidToken error, returned for any signed token which can't be
+// trusted (bad signature, unknown key, expired, malformed...).
+var (
+	ErrInvalidToken = errors.New("invalid signed token")
+)
+
+// Define a Claims struct holding everything the middleware needs to know about a user
+// without going to the database. The token family is kept in the standard "sid" claim
+// so that logging out can revoke the refresh token issued alongside it.
+type Claims struct {
+	jwt.RegisteredClaims
+	Family      string           `json:"sid,omitempty"`
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+// UserID returns the ID of the user the claims were issued to.
+func (c *Claims) UserID() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// Define a Signer struct which holds all the known signing keys indexed by their key ID.
+// New tokens are always signed with the current key, but tokens signed with any of the
+// other keys are still accepted, which lets us rotate keys without logging everyone out.
+type Signer struct {
+	keys       map[string][]byte
+	currentKID string
+	issuer     string
+}
+
+// NewSigner() parses the provided keys, each in the format "<kid>:<secret>". The first
+// key in the slice becomes the current signing key.
+func NewSigner(issuer string, keys []string) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key must be provided")
+	}
+
+	s := &Signer{
+		keys:   make(map[string][]byte),
+		issuer: issuer,
+	}
+
+	for i, key := range keys {
+		kid, secret, found := strings.Cut(key, ":")
+		if !found || kid == "" {
+			return nil, fmt.Errorf("invalid signing key at position %d: must be in the format <kid>:<secret>", i+1)
+		}
+
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("invalid signing key %q: secret must be at least 32 bytes long", kid)
+		}
+
+		s.keys[kid] = []byte(secret)
+
+		if i == 0 {
+			s.currentKID = kid
+		}
+	}
+
+	return s, nil
+}
+
+// Sign() generates a new signed access token for the user, embedding their activation
+// state and permissions. The result is returned as a data.Token so that it is sent to
+// the client in exactly the same shape as a stateful token.
+func (s *Signer) Sign(user *data.User, permissions data.Permissions, family string, ttl time.Duration) (*data.Token, error) {
+	now := time.Now()
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Family:      family,
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	jwtToken.Header["kid"] = s.currentKID
+
+	plaintext, err := jwtToken.SignedString(s.keys[s.currentKID])
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    claims.ExpiresAt.Time,
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}, nil
+}
+
+// Verify() checks the signature and the registered claims of a signed token, using the
+// key identified by its "kid" header, and returns its claims.
+func (s *Signer) Verify(tokenPlaintext string) (*Claims, error) {
+	var claims Claims
+
+	_, err := jwt.ParseWithClaims(tokenPlaintext, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+
+		key, ok := s.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return &claims, nil
+}
+
+// IsSigned() reports whether a token looks like a signed token rather than an opaque
+// stateful one. It only checks the format; call Verify() to check it can be trusted.
+func IsSigned(tokenPlaintext string) bool {
+	return strings.Count(tokenPlaintext, ".") == 2
+}
@@ -0,0 +1,90 @@
+package breached
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Define a Corpus type to hold the SHA-1 hashes of passwords which are known to have
+// appeared in data breaches. Like the Pwned Passwords range API, the hashes are grouped
+// by the first five hex characters (the prefix) and only the remaining characters (the
+// suffix) are stored, so a lookup never needs more than the prefix to find its bucket.
+type Corpus struct {
+	ranges map[string]map[string]struct{}
+	size   int
+}
+
+// Load() reads a corpus file in the format used by the Pwned Passwords downloads: one
+// upper-case SHA-1 hash per line, optionally followed by a colon and the number of
+// times it has been seen. Blank lines and lines starting with # are ignored.
+func Load(path string) (*Corpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c := &Corpus{ranges: make(map[string]map[string]struct{})}
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("breached password corpus: invalid hash on line %d", line)
+		}
+
+		prefix, suffix := hash[:5], hash[5:]
+
+		if c.ranges[prefix] == nil {
+			c.ranges[prefix] = make(map[string]struct{})
+		}
+
+		if _, exists := c.ranges[prefix][suffix]; !exists {
+			c.ranges[prefix][suffix] = struct{}{}
+			c.size++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Len() returns the number of hashes in the corpus.
+func (c *Corpus) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.size
+}
+
+// Contains() reports whether the password appears in the corpus. It is safe to call on
+// a nil Corpus, which contains nothing.
+func (c *Corpus) Contains(password string) bool {
+	if c == nil {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := c.ranges[hash[:5]][hash[5:]]
+	return found
+}
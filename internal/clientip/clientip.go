@@ -0,0 +1,178 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Define the forwarded headers that the resolver knows how to read.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+	HeaderForwarded     = "Forwarded"
+)
+
+// Resolver works out the IP address of the client making a request. The forwarded
+// headers can be set by anyone, so they are only believed when the request comes from
+// one of the trusted proxies. Walking the chain of addresses in the header from right to
+// left, every address added by a trusted proxy is skipped, and the first address which
+// isn't trusted is the client. Without any trusted proxies, the forwarded headers are
+// ignored altogether and the client is the remote address of the connection.
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// NewResolver() returns a new Resolver which trusts the proxies in the given CIDR ranges
+// (single addresses are also accepted) and reads the client address from the given
+// header.
+func NewResolver(trustedProxies []string, header string) (*Resolver, error) {
+	header = http.CanonicalHeaderKey(header)
+
+	switch header {
+	case HeaderXForwardedFor, http.CanonicalHeaderKey(HeaderXRealIP), HeaderForwarded:
+	default:
+		return nil, fmt.Errorf("clientip: unsupported forwarded header %q", header)
+	}
+
+	resolver := &Resolver{header: header}
+
+	for _, proxy := range trustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("clientip: invalid trusted proxy %q", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		resolver.trusted = append(resolver.trusted, prefix.Masked())
+	}
+
+	return resolver, nil
+}
+
+// ClientIP() returns the IP address of the client making the request.
+func (res *Resolver) ClientIP(r *http.Request) string {
+	remote := remoteAddr(r)
+	if !remote.IsValid() {
+		return r.RemoteAddr
+	}
+
+	if !res.isTrusted(remote) {
+		return remote.String()
+	}
+
+	chain := res.forwardedChain(r)
+
+	// Walk the chain from the closest hop backwards. If an address can't be parsed we
+	// stop there, as everything before it could have been made up by the client.
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(chain[i])
+		if !ok {
+			break
+		}
+
+		client = addr
+		if !res.isTrusted(addr) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// The isTrusted() method reports whether the address belongs to a trusted proxy.
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The forwardedChain() method returns the addresses from the configured header, in the
+// order in which they were added. Proxies may send the header several times, in which
+// case the values are joined in order.
+func (res *Resolver) forwardedChain(r *http.Request) []string {
+	values := r.Header.Values(res.header)
+
+	var chain []string
+
+	switch res.header {
+	case HeaderForwarded:
+		for _, value := range values {
+			chain = append(chain, parseForwarded(value)...)
+		}
+	default:
+		for _, value := range values {
+			for _, part := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(part))
+			}
+		}
+	}
+
+	return chain
+}
+
+// The parseForwarded() function returns the for= parameter of each element of an RFC
+// 7239 Forwarded header, such as `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`.
+// Elements without a for= parameter are returned as empty strings, which stop the walk
+// through the chain.
+func parseForwarded(value string) []string {
+	var chain []string
+
+	for _, element := range strings.Split(value, ",") {
+		node := ""
+
+		for _, pair := range strings.Split(element, ";") {
+			name, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				node = strings.Trim(val, `"`)
+				break
+			}
+		}
+
+		chain = append(chain, node)
+	}
+
+	return chain
+}
+
+// The parseAddr() function parses an address from a forwarded header, which may include
+// a port and, for IPv6 addresses, square brackets. Obfuscated identifiers and "unknown"
+// are not addresses.
+func parseAddr(value string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// The remoteAddr() function returns the address of the peer that opened the connection.
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addr.Unmap()
+}
@@ -14,8 +14,11 @@ import (
 
 	"github.com/joho/godotenv"
 
+	"github.com/AguilaMike/greenlight/internal/auth"
+	"github.com/AguilaMike/greenlight/internal/clientip"
 	"github.com/AguilaMike/greenlight/internal/data"
 	"github.com/AguilaMike/greenlight/internal/mailer"
+	"github.com/AguilaMike/greenlight/internal/ratelimit"
 	"github.com/AguilaMike/greenlight/internal/vcs"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
 )
@@ -55,10 +58,69 @@ type Config struct {
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
 	// altogether.
+	//
+	// Requests are split into route groups, each with its own limit: the auth group
+	// covers the paths that accept credentials (matched by prefix) and has the strictest
+	// limit, the read group covers every other GET, HEAD and OPTIONS request, and Rps and
+	// Burst apply to everything else. Within each group, clients are limited by API key
+	// or authenticated user when KeyBy is "user", falling back to their IP address for
+	// anonymous requests, or always by IP address when KeyBy is "ip". On top of that,
+	// IPRps and IPBurst cap the requests from each IP address before they are
+	// authenticated, so that requests with invalid credentials are limited too.
 	Limiter struct {
-		Rps     float64 `env:"LIMITER_RPS" flag:"limiter-rps" default:"2" desc:"Rate limiter maximum requests per second"`
-		Burst   int     `env:"LIMITER_BURST" flag:"limiter-burst" default:"4" desc:"Rate limiter maximum burst"`
-		Enabled bool    `env:"LIMITER_ENABLED" flag:"limiter-enabled" default:"true" desc:"Enable rate limiter"`
+		Rps       float64  `env:"LIMITER_RPS" flag:"limiter-rps" default:"2" desc:"Rate limiter maximum requests per second"`
+		Burst     int      `env:"LIMITER_BURST" flag:"limiter-burst" default:"4" desc:"Rate limiter maximum burst"`
+		ReadRps   float64  `env:"LIMITER_READ_RPS" flag:"limiter-read-rps" default:"4" desc:"Rate limiter maximum requests per second for reads"`
+		ReadBurst int      `env:"LIMITER_READ_BURST" flag:"limiter-read-burst" default:"8" desc:"Rate limiter maximum burst for reads"`
+		AuthRps   float64  `env:"LIMITER_AUTH_RPS" flag:"limiter-auth-rps" default:"0.2" desc:"Rate limiter maximum requests per second for authentication paths"`
+		AuthBurst int      `env:"LIMITER_AUTH_BURST" flag:"limiter-auth-burst" default:"5" desc:"Rate limiter maximum burst for authentication paths"`
+		IPRps     float64  `env:"LIMITER_IP_RPS" flag:"limiter-ip-rps" default:"10" desc:"Rate limiter maximum requests per second for each IP address, before authentication"`
+		IPBurst   int      `env:"LIMITER_IP_BURST" flag:"limiter-ip-burst" default:"20" desc:"Rate limiter maximum burst for each IP address, before authentication"`
+		AuthPaths []string `env:"LIMITER_AUTH_PATHS" flag:"limiter-auth-paths" default:"/v1/tokens /v1/oauth/token /v1/users/password /v1/invitations/redeem" desc:"Path prefixes of the authentication route group"`
+		KeyBy     string   `env:"LIMITER_KEY_BY" flag:"limiter-key-by" default:"user" desc:"Rate limiter client key (user|ip)"`
+		Enabled   bool     `env:"LIMITER_ENABLED" flag:"limiter-enabled" default:"true" desc:"Enable rate limiter"`
+		// The store holding the rate limiter state: "memory" keeps it in the current
+		// process, while "redis" shares it between every replica of the application.
+		Store    string `env:"LIMITER_STORE" flag:"limiter-store" default:"memory" desc:"Rate limiter store (memory|redis)"`
+		RedisURL string `env:"LIMITER_REDIS_URL" flag:"limiter-redis-url" default:"redis://localhost:6379/0" desc:"Redis URL for the rate limiter store"`
+	}
+	// Add a compression struct to control the compression of response bodies.
+	// Responses smaller than the minimum size (in bytes) are sent uncompressed.
+	Compression struct {
+		Enabled bool `env:"COMPRESSION_ENABLED" flag:"compression-enabled" default:"true" desc:"Enable response compression"`
+		MinSize int  `env:"COMPRESSION_MIN_SIZE" flag:"compression-min-size" default:"1024" desc:"Minimum response size to compress, in bytes"`
+	}
+	// Add a security headers struct to control the headers which tell browsers how to
+	// treat our responses. The HSTS max age, content security policy and referrer policy
+	// default to the values for the environment (see securityHeaderDefaults), unless they
+	// are set explicitly. A max age of 0 disables the Strict-Transport-Security header.
+	SecurityHeaders struct {
+		Enabled               bool          `env:"SECURITY_HEADERS_ENABLED" flag:"security-headers-enabled" default:"true" desc:"Enable the security headers"`
+		HSTSMaxAge            time.Duration `env:"SECURITY_HSTS_MAX_AGE" flag:"security-hsts-max-age" default:"-1s" desc:"Strict-Transport-Security max age (0 to disable, negative for the environment default)"`
+		ContentSecurityPolicy string        `env:"SECURITY_CSP" flag:"security-csp" default:"" desc:"Content-Security-Policy for HTML responses (empty for the environment default)"`
+		ReferrerPolicy        string        `env:"SECURITY_REFERRER_POLICY" flag:"security-referrer-policy" default:"" desc:"Referrer-Policy (empty for the environment default)"`
+	}
+	// Add a metrics struct holding the address of the separate listener which serves the
+	// Prometheus metrics at GET /metrics. It listens on localhost by default, so that the
+	// metrics aren't exposed to the clients of the API. An empty address disables it.
+	Metrics struct {
+		Addr string `env:"METRICS_ADDR" flag:"metrics-addr" default:"localhost:9090" desc:"Address of the metrics listener (empty to disable)"`
+	}
+	// Add a tracing struct to configure where the OpenTelemetry spans are exported to
+	// ("none", "stdout" or "otlp"), and the fraction of traces which are sampled.
+	Tracing struct {
+		Exporter     string  `env:"TRACING_EXPORTER" flag:"tracing-exporter" default:"none" desc:"Tracing exporter (none|stdout|otlp)"`
+		OTLPEndpoint string  `env:"TRACING_OTLP_ENDPOINT" flag:"tracing-otlp-endpoint" default:"localhost:4318" desc:"OTLP collector host and port"`
+		OTLPInsecure bool    `env:"TRACING_OTLP_INSECURE" flag:"tracing-otlp-insecure" default:"true" desc:"Connect to the OTLP collector without TLS"`
+		SampleRatio  float64 `env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" default:"1" desc:"Fraction of traces sampled"`
+	}
+	// Add a proxy struct holding the CIDR ranges of the reverse proxies and load
+	// balancers in front of the application, and the header they use to pass on the
+	// client IP address (X-Forwarded-For, X-Real-IP or the RFC 7239 Forwarded header).
+	// The header is only trusted on requests coming from one of these proxies.
+	Proxy struct {
+		TrustedProxies []string `env:"PROXY_TRUSTED_PROXIES" flag:"proxy-trusted-proxies" default:"" desc:"Trusted proxy CIDR ranges"`
+		Header         string   `env:"PROXY_HEADER" flag:"proxy-header" default:"X-Forwarded-For" desc:"Header carrying the client IP address (X-Forwarded-For|X-Real-IP|Forwarded)"`
 	}
 	Smtp struct {
 		Host     string `env:"SMTP_HOST" flag:"smtp-host" default:"sandbox.smtp.mailtrap.io" desc:"SMTP host"`
@@ -71,6 +133,88 @@ type Config struct {
 	Cors struct {
 		TrustedOrigins []string `env:"CORS_TRUSTED_ORIGINS" flag:"cors-trusted-origins" default:"http://localhost:4000" desc:"CORS trusted origins"`
 	}
+	// Add an auth struct holding the lifetimes of the short-lived access tokens and the
+	// long-lived refresh tokens issued when a user logs in. The token mode controls
+	// whether access tokens are stored in the database or signed, in which case the
+	// first signing key (in the format "<kid>:<secret>") is used to sign new tokens and
+	// the rest are only used to verify older ones.
+	Auth struct {
+		AccessTokenTTL  time.Duration `env:"AUTH_ACCESS_TOKEN_TTL" flag:"auth-access-token-ttl" default:"15m" desc:"Authentication access token lifetime"`
+		RefreshTokenTTL time.Duration `env:"AUTH_REFRESH_TOKEN_TTL" flag:"auth-refresh-token-ttl" default:"720h" desc:"Authentication refresh token lifetime"`
+		TokenMode       string        `env:"AUTH_TOKEN_MODE" flag:"auth-token-mode" default:"stateful" desc:"Authentication token mode (stateful|signed)"`
+		SigningKeys     []string      `env:"AUTH_SIGNING_KEYS" flag:"auth-signing-keys" default:"" desc:"Authentication token signing keys"`
+		EncryptionKey   string        `env:"AUTH_ENCRYPTION_KEY" flag:"auth-encryption-key" default:"" desc:"Base64-encoded 32-byte key used to encrypt two-factor secrets"`
+	}
+	// Add a password struct holding the policy that new passwords must follow. The
+	// breached file is an optional list of SHA-1 hashes of leaked passwords, in the
+	// format used by the Pwned Passwords downloads, which is loaded at startup. The
+	// hashing settings apply to new passwords; existing hashes are upgraded to them
+	// transparently the next time each user logs in.
+	Password struct {
+		MinLength        int    `env:"PASSWORD_MIN_LENGTH" flag:"password-min-length" default:"8" desc:"Minimum password length in characters"`
+		RequireUpper     bool   `env:"PASSWORD_REQUIRE_UPPER" flag:"password-require-upper" default:"false" desc:"Require an upper-case letter in passwords"`
+		RequireLower     bool   `env:"PASSWORD_REQUIRE_LOWER" flag:"password-require-lower" default:"false" desc:"Require a lower-case letter in passwords"`
+		RequireDigit     bool   `env:"PASSWORD_REQUIRE_DIGIT" flag:"password-require-digit" default:"false" desc:"Require a digit in passwords"`
+		RequireSymbol    bool   `env:"PASSWORD_REQUIRE_SYMBOL" flag:"password-require-symbol" default:"false" desc:"Require a symbol in passwords"`
+		DisallowPersonal bool   `env:"PASSWORD_DISALLOW_PERSONAL" flag:"password-disallow-personal" default:"true" desc:"Reject passwords containing the user's name or email"`
+		BreachedFile     string `env:"PASSWORD_BREACHED_FILE" flag:"password-breached-file" default:"" desc:"Path to a file of breached password SHA-1 hashes"`
+		HashAlgorithm    string `env:"PASSWORD_HASH_ALGORITHM" flag:"password-hash-algorithm" default:"argon2id" desc:"Password hashing algorithm (bcrypt|argon2id)"`
+		BcryptCost       int    `env:"PASSWORD_BCRYPT_COST" flag:"password-bcrypt-cost" default:"12" desc:"bcrypt cost"`
+		Argon2Time       int    `env:"PASSWORD_ARGON2_TIME" flag:"password-argon2-time" default:"2" desc:"argon2id number of iterations"`
+		Argon2Memory     int    `env:"PASSWORD_ARGON2_MEMORY" flag:"password-argon2-memory" default:"19456" desc:"argon2id memory in KiB"`
+		Argon2Threads    int    `env:"PASSWORD_ARGON2_THREADS" flag:"password-argon2-threads" default:"1" desc:"argon2id degree of parallelism"`
+	}
+	// Add an oidc struct holding the settings of an external OpenID Connect identity
+	// provider that users can sign in with. Signing in with OIDC is disabled unless an
+	// issuer URL is set. The redirect URL must point at GET /v1/oidc/callback.
+	OIDC struct {
+		Name         string   `env:"OIDC_NAME" flag:"oidc-name" default:"oidc" desc:"OIDC provider name stored with linked identities"`
+		Issuer       string   `env:"OIDC_ISSUER" flag:"oidc-issuer" default:"" desc:"OIDC issuer URL"`
+		ClientID     string   `env:"OIDC_CLIENT_ID" flag:"oidc-client-id" default:"" desc:"OIDC client ID"`
+		ClientSecret string   `env:"OIDC_CLIENT_SECRET" flag:"oidc-client-secret" default:"" desc:"OIDC client secret"`
+		RedirectURL  string   `env:"OIDC_REDIRECT_URL" flag:"oidc-redirect-url" default:"http://localhost:4000/v1/oidc/callback" desc:"OIDC redirect URL"`
+		Scopes       []string `env:"OIDC_SCOPES" flag:"oidc-scopes" default:"openid email profile" desc:"OIDC scopes"`
+	}
+	// Add an oauth struct holding the settings of the OAuth 2.0 authorization server,
+	// which lets third-party applications access the API on behalf of our users.
+	OAuth struct {
+		AccessTokenTTL time.Duration `env:"OAUTH_ACCESS_TOKEN_TTL" flag:"oauth-access-token-ttl" default:"1h" desc:"OAuth access token lifetime"`
+	}
+	// Add a registration struct to control how new users can sign up. When open
+	// registration is disabled, new users can only sign up with an invitation sent by
+	// an administrator, which expires after the invitation TTL.
+	Registration struct {
+		Open          bool          `env:"REGISTRATION_OPEN" flag:"registration-open" default:"true" desc:"Allow anyone to register"`
+		InvitationTTL time.Duration `env:"REGISTRATION_INVITATION_TTL" flag:"registration-invitation-ttl" default:"168h" desc:"Invitation lifetime"`
+	}
+	// Add a token cleanup struct to control the background job which purges expired
+	// tokens from the database. The same job also purges expired idempotency keys, OIDC
+	// states and OAuth codes and access tokens, in batches of the same size. Setting the
+	// interval to 0 disables the job.
+	TokenCleanup struct {
+		Interval  time.Duration `env:"TOKEN_CLEANUP_INTERVAL" flag:"token-cleanup-interval" default:"1h" desc:"Interval between purges of expired tokens, idempotency keys, OIDC states and OAuth grants (0 to disable)"`
+		BatchSize int           `env:"TOKEN_CLEANUP_BATCH_SIZE" flag:"token-cleanup-batch-size" default:"1000" desc:"Maximum number of expired rows deleted per statement"`
+	}
+	// Add an idempotency struct to control how long the response to a request made
+	// with an Idempotency-Key header is kept, so that it can be replayed on retries, and
+	// how long a key can be held by a request that hasn't finished before a retry may
+	// claim it again.
+	Idempotency struct {
+		TTL         time.Duration `env:"IDEMPOTENCY_TTL" flag:"idempotency-ttl" default:"24h" desc:"How long idempotency keys and their responses are kept"`
+		LockTimeout time.Duration `env:"IDEMPOTENCY_LOCK_TIMEOUT" flag:"idempotency-lock-timeout" default:"1m" desc:"How long a request can hold an idempotency key before a retry may reclaim it"`
+	}
+	// Add a login struct to control the brute-force protection on the login endpoint.
+	// Each failed attempt doubles the delay before the next attempt is allowed (from
+	// BaseDelay up to MaxDelay), and once an account or IP address reaches its maximum
+	// number of failures within the window it is locked out for the lockout duration.
+	Login struct {
+		MaxAttempts      int           `env:"LOGIN_MAX_ATTEMPTS" flag:"login-max-attempts" default:"5" desc:"Failed logins allowed per account before a lockout"`
+		MaxAttemptsPerIP int           `env:"LOGIN_MAX_ATTEMPTS_PER_IP" flag:"login-max-attempts-per-ip" default:"20" desc:"Failed logins allowed per IP address before a lockout"`
+		BaseDelay        time.Duration `env:"LOGIN_BASE_DELAY" flag:"login-base-delay" default:"1s" desc:"Delay enforced after the first failed login"`
+		MaxDelay         time.Duration `env:"LOGIN_MAX_DELAY" flag:"login-max-delay" default:"1m" desc:"Maximum delay enforced between failed logins"`
+		Window           time.Duration `env:"LOGIN_FAILURE_WINDOW" flag:"login-failure-window" default:"1h" desc:"Period after which failed logins are forgotten"`
+		Lockout          time.Duration `env:"LOGIN_LOCKOUT" flag:"login-lockout" default:"15m" desc:"Lockout duration"`
+	}
 }
 
 func (c *Config) InitConfig() error {
@@ -86,9 +230,56 @@ func (c *Config) InitConfig() error {
 
 	flag.Parse()
 
+	c.applyEnvironmentDefaults()
+
 	return nil
 }
 
+// Define the security header defaults for each environment. Development is usually
+// served over plain HTTP, so it doesn't send Strict-Transport-Security or ask browsers
+// to upgrade requests to HTTPS. Staging uses a short HSTS max age, so that a mistake in
+// its TLS setup doesn't lock browsers out for long.
+var securityHeaderDefaults = map[EnvType]struct {
+	HSTSMaxAge            time.Duration
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+}{
+	Development: {
+		HSTSMaxAge:            0,
+		ContentSecurityPolicy: "default-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+	},
+	Staging: {
+		HSTSMaxAge:            24 * time.Hour,
+		ContentSecurityPolicy: "default-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'; upgrade-insecure-requests",
+		ReferrerPolicy:        "no-referrer",
+	},
+	Production: {
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		ContentSecurityPolicy: "default-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'; upgrade-insecure-requests",
+		ReferrerPolicy:        "no-referrer",
+	},
+}
+
+// The applyEnvironmentDefaults() method fills in the settings which default to a
+// different value in each environment and weren't set explicitly. It must run once the
+// environment and the flags have been loaded.
+func (c *Config) applyEnvironmentDefaults() {
+	defaults := securityHeaderDefaults[c.Env]
+
+	if c.SecurityHeaders.HSTSMaxAge < 0 {
+		c.SecurityHeaders.HSTSMaxAge = defaults.HSTSMaxAge
+	}
+
+	if c.SecurityHeaders.ContentSecurityPolicy == "" {
+		c.SecurityHeaders.ContentSecurityPolicy = defaults.ContentSecurityPolicy
+	}
+
+	if c.SecurityHeaders.ReferrerPolicy == "" {
+		c.SecurityHeaders.ReferrerPolicy = defaults.ReferrerPolicy
+	}
+}
+
 func loadStructConfig(cfg interface{}, c *Config) error {
 	v := reflect.ValueOf(cfg).Elem()
 	t := v.Type()
@@ -147,6 +338,14 @@ func loadStructConfig(cfg interface{}, c *Config) error {
 					}
 					field.SetInt(int64(intValue))
 				case reflect.Int64:
+					if field.Type().String() == "time.Duration" {
+						durationValue, err := time.ParseDuration(envValue)
+						if err != nil {
+							return err
+						}
+						field.SetInt(int64(durationValue))
+						continue
+					}
 					intValue, err := strconv.ParseInt(envValue, 10, 64)
 					if err != nil {
 						return err
@@ -247,5 +446,15 @@ type Application struct {
 	Worker *helper.AppWorker
 	Models data.Models
 	Mailer mailer.Mailer
-	Wg     *sync.WaitGroup
+	Signer *auth.Signer
+	Cipher *auth.Cipher
+	// The external identity provider, which is nil unless OIDC sign-in is enabled.
+	OIDC *auth.OIDCProvider
+	// The password policy applied whenever a user chooses a new password.
+	PasswordPolicy *data.PasswordPolicy
+	// The store holding the state of the rate limiter.
+	RateLimiter ratelimit.Store
+	// The resolver used to work out the IP address of the client behind any proxies.
+	IPResolver *clientip.Resolver
+	Wg         *sync.WaitGroup
 }
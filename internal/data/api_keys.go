@@ -0,0 +1,254 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/AguilaMike/greenlight/internal/validator"
+)
+
+// All API keys start with this prefix, which makes them easy to recognise (and to spot
+// if they are ever leaked in logs or source code).
+const apiKeyPrefix = "gl_"
+
+// Define an APIKey struct to hold the data for a long-lived API key. Like tokens, only
+// the SHA-256 hash of the key is stored and the plaintext is only ever sent to the user
+// once, when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	// API keys live much longer than tokens, so we use 32 random bytes rather than 16.
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+// Check that the plaintext API key has been provided and looks like one of ours.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(apiKeyPrefix)+52, "key", "must be a valid API key")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// The New() method is a shortcut which creates a new APIKey struct and then inserts the
+// data in the api_keys table.
+func (m APIKeyModel) New(ctx context.Context, userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, key)
+	return key, err
+}
+
+// Insert() adds the data for a specific API key to the api_keys table.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	query := `
+        INSERT INTO api_keys (user_id, name, hash, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser() returns all the API keys belonging to a specific user, including the
+// expired ones, so that the user can see them and clean them up.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, created_at, user_id, name, permissions, expiry, last_used_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForKey() returns an unexpired API key along with the details of the user who owns
+// it. If no matching key is found we return an ErrRecordNotFound error.
+func (m APIKeyModel) GetForKey(ctx context.Context, keyPlaintext string) (*APIKey, *User, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+        SELECT api_keys.id, api_keys.created_at, api_keys.user_id, api_keys.name, api_keys.permissions,
+            api_keys.expiry, api_keys.last_used_at,
+            users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.totp_secret, users.totp_enabled, users.version
+        FROM api_keys
+        INNER JOIN users
+        ON users.id = api_keys.user_id
+        WHERE api_keys.hash = $1
+        AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &key, &user, nil
+}
+
+// Touch() records that an API key has just been used. Like TokenModel.Touch(), the
+// last_used_at column is only updated if it is more than a minute old.
+func (m APIKeyModel) Touch(ctx context.Context, id int64) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = $2
+        WHERE id = $1
+        AND (last_used_at IS NULL OR last_used_at < $2 - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, time.Now())
+	return err
+}
+
+// Delete() deletes a specific API key belonging to a specific user.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
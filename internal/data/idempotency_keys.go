@@ -0,0 +1,193 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Define an IdempotencyKey struct to hold the response to a request made with an
+// Idempotency-Key header, so that it can be replayed if the client retries the request.
+// The owner is the user (or, for anonymous requests, the IP address) the key belongs
+// to, and the request hash identifies the request the key was first used for. The
+// status code is 0 while the first request is still being processed. The fence is a
+// random UUID, set again each time the key is claimed, which identifies the request
+// holding the key in case it is reclaimed by a retry. (The creation time can't be used
+// for this, as it only has a precision of a second.)
+type IdempotencyKey struct {
+	Owner       string
+	Key         string
+	CreatedAt   time.Time
+	Fence       string
+	Expiry      time.Time
+	RequestHash []byte
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+}
+
+// InProgress() reports whether the first request made with the key hasn't finished yet.
+func (k *IdempotencyKey) InProgress() bool {
+	return k.StatusCode == 0
+}
+
+// IdempotencyRequestHash() returns the hash identifying a request, made from its
+// method, path and body.
+func IdempotencyRequestHash(method, path string, body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Define the IdempotencyKeyModel type.
+type IdempotencyKeyModel struct {
+	DB *sql.DB
+}
+
+// Start() claims the key for a new request. If the key is free (or has expired) it is
+// stored with the request hash, and Start() returns it along with true. Otherwise it
+// returns the existing key along with false, so that the caller can replay its response.
+// A key which is still held by a request after the lock timeout is assumed to have been
+// abandoned (for example because the process handling it died), and is claimed again.
+func (m IdempotencyKeyModel) Start(ctx context.Context, owner, key string, requestHash []byte, ttl, lockTimeout time.Duration) (*IdempotencyKey, bool, error) {
+	query := `
+        INSERT INTO idempotency_keys (owner, key, expiry, request_hash)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (owner, key) DO UPDATE
+        SET created_at = NOW(), fence = gen_random_uuid(), expiry = EXCLUDED.expiry, request_hash = EXCLUDED.request_hash,
+            status_code = NULL, header = NULL, body = NULL
+        WHERE idempotency_keys.expiry < NOW()
+            OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW() - make_interval(secs => $5))
+        RETURNING created_at, fence, expiry`
+
+	args := []any{owner, key, time.Now().Add(ttl), requestHash, lockTimeout.Seconds()}
+
+	queryCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	idempotencyKey := IdempotencyKey{
+		Owner:       owner,
+		Key:         key,
+		RequestHash: requestHash,
+	}
+
+	err := m.DB.QueryRowContext(queryCtx, query, args...).Scan(&idempotencyKey.CreatedAt, &idempotencyKey.Fence, &idempotencyKey.Expiry)
+	switch {
+	case err == nil:
+		return &idempotencyKey, true, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, false, err
+	}
+
+	existing, err := m.Get(ctx, owner, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return existing, false, nil
+}
+
+// Get() retrieves a key by its owner and value.
+func (m IdempotencyKeyModel) Get(ctx context.Context, owner, key string) (*IdempotencyKey, error) {
+	query := `
+        SELECT owner, key, created_at, fence, expiry, request_hash, coalesce(status_code, 0), coalesce(header, '{}'), coalesce(body, '')
+        FROM idempotency_keys
+        WHERE owner = $1 AND key = $2`
+
+	var idempotencyKey IdempotencyKey
+	var header []byte
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, owner, key).Scan(
+		&idempotencyKey.Owner,
+		&idempotencyKey.Key,
+		&idempotencyKey.CreatedAt,
+		&idempotencyKey.Fence,
+		&idempotencyKey.Expiry,
+		&idempotencyKey.RequestHash,
+		&idempotencyKey.StatusCode,
+		&header,
+		&idempotencyKey.Body,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(header, &idempotencyKey.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &idempotencyKey, nil
+}
+
+// Complete() stores the response to the request holding the key. If the key has been
+// reclaimed by another request in the meantime, it is left alone.
+func (m IdempotencyKeyModel) Complete(ctx context.Context, idempotencyKey *IdempotencyKey, statusCode int, header http.Header, body []byte) error {
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        UPDATE idempotency_keys
+        SET status_code = $4, header = $5, body = $6
+        WHERE owner = $1 AND key = $2 AND fence = $3 AND status_code IS NULL`
+
+	args := []any{idempotencyKey.Owner, idempotencyKey.Key, idempotencyKey.Fence, statusCode, encodedHeader, body}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Delete() releases a key held by a request, so that the request can be retried from
+// scratch. If the key has been reclaimed by another request in the meantime, it is left
+// alone.
+func (m IdempotencyKeyModel) Delete(ctx context.Context, idempotencyKey *IdempotencyKey) error {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE owner = $1 AND key = $2 AND fence = $3 AND status_code IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, idempotencyKey.Owner, idempotencyKey.Key, idempotencyKey.Fence)
+	return err
+}
+
+// DeleteExpired() deletes up to batchSize keys which have passed their expiry time, and
+// returns how many were deleted.
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+        DELETE FROM idempotency_keys
+        WHERE (owner, key) IN (
+            SELECT owner, key FROM idempotency_keys
+            WHERE expiry < NOW()
+            LIMIT $1
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
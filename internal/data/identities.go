@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// Define an IdentityModel type which links users to their accounts with external
+// identity providers.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// GetUser() returns the user linked to the account with the subject at the provider. If
+// no account is linked we return an ErrRecordNotFound error.
+func (m IdentityModel) GetUser(ctx context.Context, provider, subject string) (*User, error) {
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+            users.totp_secret, users.totp_enabled, users.version
+        FROM users
+        INNER JOIN user_identities
+        ON users.id = user_identities.user_id
+        WHERE user_identities.provider = $1
+        AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Insert() links the account with the subject at the provider to a specific user.
+func (m IdentityModel) Insert(ctx context.Context, userID int64, provider, subject string) error {
+	query := `
+        INSERT INTO user_identities (user_id, provider, subject)
+        VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, provider, subject)
+	return err
+}
+
+// Define an OIDCState struct to hold the values generated when a user starts signing in
+// with an external identity provider, which must be checked when they come back. Only
+// a hash of the state is stored, like our tokens.
+type OIDCState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// Define the OIDCStateModel type.
+type OIDCStateModel struct {
+	DB *sql.DB
+}
+
+// randomURLString() returns n random bytes encoded as unpadded base64url, which is safe
+// to use in URLs and, for n = 32, is a valid PKCE code verifier.
+func randomURLString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// New() generates a new state, nonce and PKCE code verifier and stores them in the
+// oidc_states table until they expire.
+func (m OIDCStateModel) New(ctx context.Context, ttl time.Duration) (*OIDCState, error) {
+	var (
+		s   = &OIDCState{Expiry: time.Now().Add(ttl)}
+		err error
+	)
+
+	for _, field := range []*string{&s.State, &s.Nonce, &s.CodeVerifier} {
+		*field, err = randomURLString(32)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+        INSERT INTO oidc_states (hash, nonce, code_verifier, expiry)
+        VALUES ($1, $2, $3, $4)`
+
+	hash := sha256.Sum256([]byte(s.State))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, hash[:], s.Nonce, s.CodeVerifier, s.Expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Consume() deletes and returns an unexpired state, so that each one can only be used
+// once. If there is no such state we return an ErrRecordNotFound error.
+func (m OIDCStateModel) Consume(ctx context.Context, state string) (*OIDCState, error) {
+	query := `
+        DELETE FROM oidc_states
+        WHERE hash = $1
+        RETURNING nonce, code_verifier, expiry`
+
+	hash := sha256.Sum256([]byte(state))
+
+	s := OIDCState{State: state}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(&s.Nonce, &s.CodeVerifier, &s.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if s.Expiry.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &s, nil
+}
+
+// DeleteExpired() deletes up to batchSize states which have passed their expiry time,
+// left behind by users who never came back from the identity provider, and returns how
+// many were deleted.
+func (m OIDCStateModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+        DELETE FROM oidc_states
+        WHERE hash IN (
+            SELECT hash FROM oidc_states
+            WHERE expiry < NOW()
+            LIMIT $1
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,183 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define an Invitation struct to hold the data for an invitation to sign up. The
+// invitation itself is an ordinary token with the "invitation" scope, which belongs to
+// the user who sent it, so the invitations table only holds the extra details: the
+// email address of the person being invited and the permissions that their new account
+// will start with.
+type Invitation struct {
+	Token       *Token      `json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Email       string      `json:"email"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      time.Time   `json:"expiry"`
+}
+
+// Define the InvitationModel type.
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+// The New() method creates a new invitation token from a specific user and stores it
+// along with the details of the invitation. Any earlier invitations for the same email
+// address are deleted, so only the most recent one can be redeemed.
+func (m InvitationModel) New(ctx context.Context, inviterID int64, ttl time.Duration, email string, permissions Permissions) (*Invitation, error) {
+	token, err := generateToken(inviterID, ttl, ScopeInvitation)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &Invitation{
+		Token:       token,
+		Email:       email,
+		Permissions: permissions,
+		Expiry:      token.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        DELETE FROM tokens
+        WHERE hash IN (SELECT token_hash FROM invitations WHERE email = $1)`
+
+	_, err = tx.ExecContext(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        INSERT INTO tokens (hash, user_id, expiry, scope)
+        VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+        INSERT INTO invitations (token_hash, email, permissions)
+        VALUES ($1, $2, $3)
+        RETURNING created_at`
+
+	err = tx.QueryRowContext(ctx, query, token.Hash, email, pq.Array(permissions)).Scan(&invitation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// GetForToken() returns the invitation for an invitation token, which should already
+// have been checked with TokenModel.Get(). If there is no such invitation we return an
+// ErrRecordNotFound error.
+func (m InvitationModel) GetForToken(ctx context.Context, token *Token) (*Invitation, error) {
+	query := `
+        SELECT created_at, email, permissions
+        FROM invitations
+        WHERE token_hash = $1`
+
+	invitation := Invitation{
+		Token:  token,
+		Expiry: token.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, token.Hash).Scan(
+		&invitation.CreatedAt,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// Redeem() creates the user for an invitation, gives them the invited permissions and
+// deletes the invitation, all in a single transaction, so that the invitation can't be
+// left live for a user who already exists, or the user created without their
+// permissions. Deleting the token removes the invitation along with it, thanks to the ON
+// DELETE CASCADE constraint. If the invitation has already been redeemed in the
+// meantime we return an ErrRecordNotFound error, and if a user with the email address
+// already exists an ErrDuplicateEmail error.
+func (m InvitationModel) Redeem(ctx context.Context, invitation *Invitation, user *User) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1`, invitation.Token.Hash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        INSERT INTO users (name, email, password_hash, activated)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	query = `
+        INSERT INTO users_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(invitation.Permissions))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Define a LoginFailure struct to hold the failed login attempts recorded against a
+// specific key. The key is either an email address or an IP address (see the
+// LoginFailureKeyForEmail() and LoginFailureKeyForIP() functions), so that password
+// guessing can be slowed down both per account and per client.
+type LoginFailure struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// LoginFailureKeyForEmail() returns the key used to track failures for an account. The
+// email address is lower-cased because the users.email column is case-insensitive.
+func LoginFailureKeyForEmail(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+// LoginFailureKeyForIP() returns the key used to track failures for a client IP.
+func LoginFailureKeyForIP(ip string) string {
+	return "ip:" + ip
+}
+
+// The RetryAfter() method returns how long the client must wait before making another
+// login attempt. A lockout always takes priority; otherwise the delay doubles with each
+// consecutive failure, starting at baseDelay and capped at maxDelay. A zero duration
+// means that the client may try again straight away.
+func (f *LoginFailure) RetryAfter(now time.Time, baseDelay, maxDelay time.Duration) time.Duration {
+	if f.LockedUntil != nil && f.LockedUntil.After(now) {
+		return f.LockedUntil.Sub(now)
+	}
+
+	if f.Failures < 1 || baseDelay <= 0 {
+		return 0
+	}
+
+	delay := baseDelay
+	for i := 1; i < f.Failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+
+	return max(f.LastFailureAt.Add(delay).Sub(now), 0)
+}
+
+// Define the LoginFailureModel type.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the failures recorded for a specific key. If nothing has been recorded
+// we return an empty LoginFailure rather than an error, as that is the normal case.
+func (m LoginFailureModel) Get(ctx context.Context, key string) (*LoginFailure, error) {
+	query := `
+        SELECT key, failures, last_failure_at, locked_until
+        FROM login_failures
+        WHERE key = $1`
+
+	failure := LoginFailure{Key: key}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&failure.Key,
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// RecordFailure() increments the failure counter for a specific key and returns the
+// updated record. If the previous failure happened longer ago than the window, the
+// counter starts again from 1, so that the odd typo spread over several days never
+// builds up into a lockout.
+func (m LoginFailureModel) RecordFailure(ctx context.Context, key string, window time.Duration) (*LoginFailure, error) {
+	query := `
+        INSERT INTO login_failures (key, failures, last_failure_at)
+        VALUES ($1, 1, $2)
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE
+                WHEN login_failures.last_failure_at < $2 - make_interval(secs => $3) THEN 1
+                ELSE login_failures.failures + 1
+            END,
+            last_failure_at = $2
+        RETURNING key, failures, last_failure_at, locked_until`
+
+	var failure LoginFailure
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, time.Now(), window.Seconds()).Scan(
+		&failure.Key,
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// Lock() locks a specific key until the given time and resets its failure counter, so
+// that the exponential delay starts from scratch once the lockout is over.
+func (m LoginFailureModel) Lock(ctx context.Context, key string, until time.Time) error {
+	query := `
+        UPDATE login_failures
+        SET locked_until = $2, failures = 0
+        WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+// Delete() clears the failures recorded for a specific key, which we do after a
+// successful login.
+func (m LoginFailureModel) Delete(ctx context.Context, key string) error {
+	query := `
+        DELETE FROM login_failures
+        WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
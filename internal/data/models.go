@@ -15,19 +15,45 @@ var (
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	APIKeys         APIKeyModel
+	Identities      IdentityModel
+	Invitations     InvitationModel
+	LoginFailures   LoginFailureModel
+	Movies          MovieModel
+	OAuthClients    OAuthClientModel
+	OAuthCodes      OAuthCodeModel
+	OAuthConsents   OAuthConsentModel
+	OAuthTokens     OAuthTokenModel
+	OIDCStates      OIDCStateModel
+	Permissions     PermissionModel
+	RecoveryCodes   RecoveryCodeModel
+	Roles           RoleModel
+	SecurityEvents  SecurityEventModel
+	IdempotencyKeys IdempotencyKeyModel
+	Tokens          TokenModel
+	Users           UserModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		APIKeys:         APIKeyModel{DB: db},
+		Identities:      IdentityModel{DB: db},
+		Invitations:     InvitationModel{DB: db},
+		LoginFailures:   LoginFailureModel{DB: db},
+		Movies:          MovieModel{DB: db},
+		OAuthClients:    OAuthClientModel{DB: db},
+		OAuthCodes:      OAuthCodeModel{DB: db},
+		OAuthConsents:   OAuthConsentModel{DB: db},
+		OAuthTokens:     OAuthTokenModel{DB: db},
+		OIDCStates:      OIDCStateModel{DB: db},
+		Permissions:     PermissionModel{DB: db},
+		RecoveryCodes:   RecoveryCodeModel{DB: db},
+		Roles:           RoleModel{DB: db},
+		SecurityEvents:  SecurityEventModel{DB: db},
+		IdempotencyKeys: IdempotencyKeyModel{DB: db},
+		Tokens:          TokenModel{DB: db},
+		Users:           UserModel{DB: db},
 	}
 }
@@ -57,7 +57,7 @@ type MovieModel struct {
 // using them right now, we've set this up to accept the various filter parameters as
 // arguments.
 // Update the function signature to return a Metadata struct.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all movie records.
 	// Add an ORDER BY clause and interpolate the sort column and direction. Importantly
 	// notice that we also include a secondary sort on the movie ID to ensure a
@@ -75,7 +75,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
         LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// As our SQL query now has quite a few placeholder parameters, let's collect the
@@ -148,7 +148,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 // The Insert() method accepts a pointer to a movie struct, which should contain the
 // data for the new record.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	// Define the SQL query for inserting a new record in the movies table and returning
 	// the system-generated data.
 	query := `
@@ -162,7 +162,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
@@ -173,7 +173,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -192,7 +192,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	var movie Movie
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query using the QueryRow() method, passing in the provided id value
@@ -226,7 +226,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Add a placeholder method for updating a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version
 	// number.
 	query := `
@@ -246,7 +246,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	}
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Use the QueryRow() method to execute the query, passing in the args slice as a
@@ -269,7 +269,7 @@ func (m MovieModel) Update(movie *Movie) error {
 }
 
 // Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
@@ -281,7 +281,7 @@ func (m MovieModel) Delete(id int64) error {
         WHERE id = $1`
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the SQL query using the Exec() method, passing in the id variable as
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/AguilaMike/greenlight/internal/validator"
+)
+
+// Define an OAuthClient struct to hold the data for a third-party application which
+// can request access to the API on behalf of our users. Confidential clients (like
+// server-side applications) are given a secret; public clients (like mobile or
+// single-page applications) can't keep one, so they rely on PKCE alone. Like our
+// tokens, only the SHA-256 hash of the secret is stored.
+type OAuthClient struct {
+	ID           string      `json:"client_id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UserID       int64       `json:"-"`
+	Name         string      `json:"name"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+}
+
+// The AllowsRedirectURI() method reports whether the redirect URI has been registered
+// for the client. Redirect URIs must match exactly, as recommended by the OAuth 2.0
+// security best practices.
+func (c *OAuthClient) AllowsRedirectURI(redirectURI string) bool {
+	for _, uri := range c.RedirectURIs {
+		if subtle.ConstantTimeCompare([]byte(uri), []byte(redirectURI)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The SecretMatches() method checks the secret presented by a confidential client.
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if c.SecretHash == nil {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		v.Check(err == nil && u.IsAbs() && u.Fragment == "", "redirect_uris", "must only contain absolute URIs without a fragment")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// Define the OAuthClientModel type.
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+// The New() method generates an ID (and a secret, for confidential clients) for a new
+// client and then inserts it in the oauth_clients table.
+func (m OAuthClientModel) New(ctx context.Context, client *OAuthClient) error {
+	idBytes := make([]byte, 16)
+
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return err
+	}
+
+	client.ID = hex.EncodeToString(idBytes)
+
+	if client.Confidential {
+		secretBytes := make([]byte, 32)
+
+		_, err := rand.Read(secretBytes)
+		if err != nil {
+			return err
+		}
+
+		client.Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	query := `
+        INSERT INTO oauth_clients (id, user_id, name, secret_hash, redirect_uris, scopes)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING created_at`
+
+	args := []any{client.ID, client.UserID, client.Name, client.SecretHash, pq.Array(client.RedirectURIs), pq.Array(client.Scopes)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+// Get() returns a specific client. If there is no such client we return an
+// ErrRecordNotFound error.
+func (m OAuthClientModel) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	query := `
+        SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+        FROM oauth_clients
+        WHERE id = $1`
+
+	var client OAuthClient
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.Name,
+		&client.SecretHash,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.Scopes),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	return &client, nil
+}
+
+// GetAllForUser() returns all the clients registered by a specific user.
+func (m OAuthClientModel) GetAllForUser(ctx context.Context, userID int64) ([]*OAuthClient, error) {
+	query := `
+        SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+        FROM oauth_clients
+        WHERE user_id = $1
+        ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.UserID,
+			&client.Name,
+			&client.SecretHash,
+			pq.Array(&client.RedirectURIs),
+			pq.Array(&client.Scopes),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Confidential = client.SecretHash != nil
+
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// Delete() deletes a specific client registered by a specific user. Its consents, codes
+// and tokens are deleted along with it by the ON DELETE CASCADE constraints.
+func (m OAuthClientModel) Delete(ctx context.Context, id string, userID int64) error {
+	query := `
+        DELETE FROM oauth_clients
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// All OAuth access tokens start with this prefix, which lets us tell them apart from
+// our own authentication tokens without a database lookup.
+const oauthTokenPrefix = "glo_"
+
+// IsOAuthToken() reports whether the plaintext token looks like an OAuth access token.
+func IsOAuthToken(tokenPlaintext string) bool {
+	return strings.HasPrefix(tokenPlaintext, oauthTokenPrefix) && len(tokenPlaintext) == len(oauthTokenPrefix)+32
+}
+
+// generateOAuthSecret() returns a random plaintext value for a code or token along with
+// its SHA-256 hash, which is the only part that we store.
+func generateOAuthSecret(prefix string) (string, []byte, error) {
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := prefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return plaintext, hash[:], nil
+}
+
+// Define the OAuthConsentModel type, which records the scopes that each user has agreed
+// to grant to each client.
+type OAuthConsentModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the scopes that the user has granted to the client, which is empty if
+// they have never granted any.
+func (m OAuthConsentModel) Get(ctx context.Context, userID int64, clientID string) (Permissions, error) {
+	query := `
+        SELECT scopes
+        FROM oauth_consents
+        WHERE user_id = $1 AND client_id = $2`
+
+	var scopes Permissions
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, clientID).Scan(pq.Array(&scopes))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return scopes, nil
+}
+
+// Grant() adds the scopes to the ones that the user has already granted to the client.
+func (m OAuthConsentModel) Grant(ctx context.Context, userID int64, clientID string, scopes Permissions) error {
+	query := `
+        INSERT INTO oauth_consents (user_id, client_id, scopes)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, client_id) DO UPDATE
+        SET scopes = ARRAY(SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes))`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, clientID, pq.Array(scopes))
+	return err
+}
+
+// Revoke() deletes the consent that the user has given to the client, along with all
+// the access tokens that the client holds for the user.
+func (m OAuthConsentModel) Revoke(ctx context.Context, userID int64, clientID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Define an OAuthCode struct to hold the data for an authorization code, which a client
+// exchanges for an access token once the user has given their consent. We record
+// whether the redirect URI was sent with the authorization request, as the client only
+// has to send it again with the token request if it was (RFC 6749 section 4.1.3).
+type OAuthCode struct {
+	Plaintext           string
+	ClientID            string
+	UserID              int64
+	RedirectURI         string
+	RedirectURIProvided bool
+	Scopes              Permissions
+	CodeChallenge       string
+	Expiry              time.Time
+}
+
+// Define the OAuthCodeModel type.
+type OAuthCodeModel struct {
+	DB *sql.DB
+}
+
+// Insert() generates the plaintext for a new authorization code and stores its hash.
+func (m OAuthCodeModel) Insert(ctx context.Context, code *OAuthCode) error {
+	plaintext, hash, err := generateOAuthSecret("")
+	if err != nil {
+		return err
+	}
+
+	code.Plaintext = plaintext
+
+	query := `
+        INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, redirect_uri_provided, scopes, code_challenge, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	args := []any{hash, code.ClientID, code.UserID, code.RedirectURI, code.RedirectURIProvided, pq.Array(code.Scopes), code.CodeChallenge, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes and returns an unexpired authorization code, so that each code can
+// only be exchanged once. If there is no such code we return an ErrRecordNotFound error.
+func (m OAuthCodeModel) Consume(ctx context.Context, plaintext string) (*OAuthCode, error) {
+	query := `
+        DELETE FROM oauth_codes
+        WHERE hash = $1
+        RETURNING client_id, user_id, redirect_uri, redirect_uri_provided, scopes, code_challenge, expiry`
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	code := OAuthCode{Plaintext: plaintext}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&code.RedirectURIProvided,
+		pq.Array(&code.Scopes),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if code.Expiry.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &code, nil
+}
+
+// DeleteExpired() deletes up to batchSize authorization codes which have passed their
+// expiry time without being exchanged, and returns how many were deleted.
+func (m OAuthCodeModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+        DELETE FROM oauth_codes
+        WHERE hash IN (
+            SELECT hash FROM oauth_codes
+            WHERE expiry < NOW()
+            LIMIT $1
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Define an OAuthToken struct to hold the data for an access token issued to a client.
+// The token acts on behalf of the user, but is limited to the scopes that it was
+// granted.
+type OAuthToken struct {
+	Plaintext string      `json:"access_token"`
+	ClientID  string      `json:"-"`
+	UserID    int64       `json:"-"`
+	Scopes    Permissions `json:"-"`
+	Expiry    time.Time   `json:"-"`
+}
+
+// Define the OAuthTokenModel type.
+type OAuthTokenModel struct {
+	DB *sql.DB
+}
+
+// New() generates a new access token for the client and user and stores its hash.
+func (m OAuthTokenModel) New(ctx context.Context, clientID string, userID int64, scopes Permissions, ttl time.Duration) (*OAuthToken, error) {
+	plaintext, hash, err := generateOAuthSecret(oauthTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &OAuthToken{
+		Plaintext: plaintext,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	query := `
+        INSERT INTO oauth_tokens (hash, client_id, user_id, scopes, expiry)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{hash, token.ClientID, token.UserID, pq.Array(token.Scopes), token.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetForToken() returns an unexpired access token along with the details of the user it
+// acts on behalf of. If there is no such token we return an ErrRecordNotFound error.
+func (m OAuthTokenModel) GetForToken(ctx context.Context, tokenPlaintext string) (*OAuthToken, *User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT oauth_tokens.client_id, oauth_tokens.user_id, oauth_tokens.scopes, oauth_tokens.expiry,
+            users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+            users.totp_secret, users.totp_enabled, users.version
+        FROM oauth_tokens
+        INNER JOIN users
+        ON users.id = oauth_tokens.user_id
+        WHERE oauth_tokens.hash = $1
+        AND oauth_tokens.expiry > $2`
+
+	var (
+		token = OAuthToken{Plaintext: tokenPlaintext}
+		user  User
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+		&token.ClientID,
+		&token.UserID,
+		pq.Array(&token.Scopes),
+		&token.Expiry,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &token, &user, nil
+}
+
+// DeleteExpired() deletes up to batchSize access tokens which have passed their expiry
+// time, and returns how many were deleted.
+func (m OAuthTokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+        DELETE FROM oauth_tokens
+        WHERE hash IN (
+            SELECT hash FROM oauth_tokens
+            WHERE expiry < NOW()
+            LIMIT $1
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
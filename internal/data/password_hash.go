@@ -0,0 +1,211 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Define the supported password hashing algorithms.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// Define a PasswordHashing struct to hold the algorithm and parameters used to hash new
+// passwords. Both algorithms store their parameters in the hash itself (bcrypt in its
+// own format, argon2id in the PHC string format), so a hash can always be checked no
+// matter how the parameters have changed since it was created.
+type PasswordHashing struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    int
+	Argon2Memory  int
+	Argon2Threads int
+}
+
+// Define the largest argon2id parameters we accept. Anything higher is almost certainly
+// a mistake, and would make every login slow enough to take the server down. They also
+// keep the values within the uint32 and uint8 types that argon2 works with.
+const (
+	maxArgon2Time    = 100
+	maxArgon2Memory  = 4 * 1024 * 1024 // 4 GiB, in KiB
+	maxArgon2Threads = 255
+)
+
+// The hashing settings used by password.Set(). They default to bcrypt with a cost of 12,
+// which is what every existing hash was created with, and can be changed at startup by
+// calling SetPasswordHashing().
+var passwordHashing = PasswordHashing{
+	Algorithm:     HashBcrypt,
+	BcryptCost:    12,
+	Argon2Time:    2,
+	Argon2Memory:  19 * 1024,
+	Argon2Threads: 1,
+}
+
+// SetPasswordHashing() validates and sets the hashing settings for new passwords. It
+// must be called before the server starts handling requests.
+func SetPasswordHashing(h PasswordHashing) error {
+	switch h.Algorithm {
+	case HashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		switch {
+		case h.Argon2Time < 1 || h.Argon2Time > maxArgon2Time:
+			return fmt.Errorf("argon2id time must be between 1 and %d", maxArgon2Time)
+		case h.Argon2Threads < 1 || h.Argon2Threads > maxArgon2Threads:
+			return fmt.Errorf("argon2id threads must be between 1 and %d", maxArgon2Threads)
+		case h.Argon2Memory < 8*h.Argon2Threads || h.Argon2Memory > maxArgon2Memory:
+			return fmt.Errorf("argon2id memory must be between 8 KiB per thread and %d KiB", maxArgon2Memory)
+		}
+	default:
+		return fmt.Errorf("invalid password hashing algorithm: %s", h.Algorithm)
+	}
+
+	passwordHashing = h
+	return nil
+}
+
+// argon2Params holds the parameters decoded from an argon2id hash.
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// hashPassword() hashes the plaintext password with the current hashing settings.
+func hashPassword(plaintextPassword string) ([]byte, error) {
+	h := passwordHashing
+
+	if h.Algorithm == HashBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.BcryptCost)
+	}
+
+	salt := make([]byte, 16)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, uint32(h.Argon2Time), uint32(h.Argon2Memory), uint8(h.Argon2Threads), 32)
+
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Argon2Memory,
+		h.Argon2Time,
+		h.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(hash), nil
+}
+
+// decodeArgon2Hash() parses an argon2id hash in the PHC string format.
+func decodeArgon2Hash(hash []byte) (*argon2Params, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, errInvalidHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errInvalidHash
+	}
+
+	var p argon2Params
+
+	// argon2.IDKey() panics if the time or the number of threads is 0.
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil || p.time < 1 || p.threads < 1 {
+		return nil, errInvalidHash
+	}
+
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errInvalidHash
+	}
+
+	// An empty key would match any password, as the key derived from the password
+	// would be empty too.
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.key) == 0 {
+		return nil, errInvalidHash
+	}
+
+	return &p, nil
+}
+
+// isArgon2Hash() reports whether the hash was created with argon2id rather than bcrypt.
+func isArgon2Hash(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$"+HashArgon2id+"$")
+}
+
+// compareHashAndPassword() checks the plaintext password against a bcrypt or argon2id
+// hash, returning false (and no error) if they don't match.
+func compareHashAndPassword(hash []byte, plaintextPassword string) (bool, error) {
+	if !isArgon2Hash(hash) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	p, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+// needsRehash() reports whether the hash was created with a different algorithm or
+// different parameters from the current hashing settings.
+func needsRehash(hash []byte) bool {
+	h := passwordHashing
+
+	if !isArgon2Hash(hash) {
+		if h.Algorithm != HashBcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.BcryptCost
+	}
+
+	if h.Algorithm != HashArgon2id {
+		return true
+	}
+
+	p, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return int(p.time) != h.Argon2Time || int(p.memory) != h.Argon2Memory || int(p.threads) != h.Argon2Threads
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// Cheap settings for each algorithm, so that the tests run quickly.
+var (
+	testBcrypt   = PasswordHashing{Algorithm: HashBcrypt, BcryptCost: 4}
+	testArgon2id = PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+)
+
+// The usePasswordHashing() helper sets the hashing settings for the rest of the test,
+// restoring the previous ones when it finishes.
+func usePasswordHashing(t *testing.T, h PasswordHashing) {
+	t.Helper()
+
+	previous := passwordHashing
+	t.Cleanup(func() { passwordHashing = previous })
+
+	err := SetPasswordHashing(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPasswordHashing(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       PasswordHashing
+		wantErr bool
+	}{
+		{name: "bcrypt", h: testBcrypt},
+		{name: "argon2id", h: testArgon2id},
+		{name: "Unknown algorithm", h: PasswordHashing{Algorithm: "md5"}, wantErr: true},
+		{name: "bcrypt cost too low", h: PasswordHashing{Algorithm: HashBcrypt, BcryptCost: 3}, wantErr: true},
+		{name: "bcrypt cost too high", h: PasswordHashing{Algorithm: HashBcrypt, BcryptCost: 32}, wantErr: true},
+		{name: "argon2id zero time", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 0, Argon2Memory: 64, Argon2Threads: 1}, wantErr: true},
+		{name: "argon2id time too high", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 101, Argon2Memory: 64, Argon2Threads: 1}, wantErr: true},
+		{name: "argon2id negative memory", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: -1, Argon2Threads: 1}, wantErr: true},
+		{name: "argon2id memory too low for threads", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 15, Argon2Threads: 2}, wantErr: true},
+		{name: "argon2id memory too high", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 5 * 1024 * 1024, Argon2Threads: 1}, wantErr: true},
+		{name: "argon2id zero threads", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 0}, wantErr: true},
+		{name: "argon2id too many threads", h: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 64 * 256, Argon2Threads: 256}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := passwordHashing
+			defer func() { passwordHashing = previous }()
+
+			err := SetPasswordHashing(tt.h)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetPasswordHashing() error = %v; want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2Hash(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	t.Run("Valid", func(t *testing.T) {
+		p, err := decodeArgon2Hash([]byte("$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.memory != 19456 || p.time != 2 || p.threads != 1 {
+			t.Errorf("got m=%d,t=%d,p=%d; want m=19456,t=2,p=1", p.memory, p.time, p.threads)
+		}
+
+		if !bytes.Equal(p.salt, []byte("0123456789abcdef")) || len(p.key) != 32 {
+			t.Errorf("got salt %q and a %d-byte key", p.salt, len(p.key))
+		}
+	})
+
+	malformed := []struct {
+		name string
+		hash string
+	}{
+		{name: "Empty", hash: ""},
+		{name: "Too few parts", hash: "$argon2id$v=19$m=19456,t=2,p=1$" + salt},
+		{name: "Too many parts", hash: "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key + "$extra"},
+		{name: "Other algorithm", hash: "$argon2i$v=19$m=19456,t=2,p=1$" + salt + "$" + key},
+		{name: "Unsupported version", hash: "$argon2id$v=16$m=19456,t=2,p=1$" + salt + "$" + key},
+		{name: "Malformed version", hash: "$argon2id$19$m=19456,t=2,p=1$" + salt + "$" + key},
+		{name: "Malformed parameters", hash: "$argon2id$v=19$m=19456;t=2;p=1$" + salt + "$" + key},
+		{name: "Zero time", hash: "$argon2id$v=19$m=19456,t=0,p=1$" + salt + "$" + key},
+		{name: "Zero threads", hash: "$argon2id$v=19$m=19456,t=2,p=0$" + salt + "$" + key},
+		{name: "Malformed salt", hash: "$argon2id$v=19$m=19456,t=2,p=1$not*base64$" + key},
+		{name: "Malformed key", hash: "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$not*base64"},
+		{name: "Empty key", hash: "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$"},
+	}
+
+	for _, tt := range malformed {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeArgon2Hash([]byte(tt.hash))
+			if !errors.Is(err, errInvalidHash) {
+				t.Errorf("decodeArgon2Hash() error = %v; want %v", err, errInvalidHash)
+			}
+
+			// A hash that can't be decoded must never match a password.
+			if isArgon2Hash([]byte(tt.hash)) {
+				match, _ := compareHashAndPassword([]byte(tt.hash), "pa55word")
+				if match {
+					t.Error("compareHashAndPassword() = true; want false")
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		h        PasswordHashing
+		isArgon2 bool
+	}{
+		{name: "bcrypt", h: testBcrypt},
+		{name: "argon2id", h: testArgon2id, isArgon2: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePasswordHashing(t, tt.h)
+
+			hash, err := hashPassword("pa55word")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := isArgon2Hash(hash); got != tt.isArgon2 {
+				t.Errorf("isArgon2Hash() = %v; want %v", got, tt.isArgon2)
+			}
+
+			match, err := compareHashAndPassword(hash, "pa55word")
+			if err != nil || !match {
+				t.Errorf("compareHashAndPassword() with the right password = %v, %v; want true", match, err)
+			}
+
+			match, err = compareHashAndPassword(hash, "wrong-password")
+			if err != nil || match {
+				t.Errorf("compareHashAndPassword() with a wrong password = %v, %v; want false", match, err)
+			}
+
+			if needsRehash(hash) {
+				t.Error("needsRehash() = true for a hash made with the current settings")
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	tests := []struct {
+		name    string
+		created PasswordHashing
+		current PasswordHashing
+		want    bool
+	}{
+		{name: "Same bcrypt cost", created: testBcrypt, current: testBcrypt, want: false},
+		{name: "Different bcrypt cost", created: testBcrypt, current: PasswordHashing{Algorithm: HashBcrypt, BcryptCost: 5}, want: true},
+		{name: "bcrypt to argon2id", created: testBcrypt, current: testArgon2id, want: true},
+		{name: "argon2id to bcrypt", created: testArgon2id, current: testBcrypt, want: true},
+		{name: "Same argon2id parameters", created: testArgon2id, current: testArgon2id, want: false},
+		{name: "Different argon2id time", created: testArgon2id, current: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 2, Argon2Memory: 64, Argon2Threads: 1}, want: true},
+		{name: "Different argon2id memory", created: testArgon2id, current: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 128, Argon2Threads: 1}, want: true},
+		{name: "Different argon2id threads", created: testArgon2id, current: PasswordHashing{Algorithm: HashArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 2}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePasswordHashing(t, tt.created)
+
+			hash, err := hashPassword("pa55word")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			usePasswordHashing(t, tt.current)
+
+			if got := needsRehash(hash); got != tt.want {
+				t.Errorf("needsRehash() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Malformed argon2id hash", func(t *testing.T) {
+		usePasswordHashing(t, testArgon2id)
+
+		if !needsRehash([]byte("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$")) {
+			t.Error("needsRehash() = false; want true")
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AguilaMike/greenlight/internal/breached"
+	"github.com/AguilaMike/greenlight/internal/validator"
+)
+
+// Define a PasswordPolicy struct to hold the rules that new passwords must follow. It
+// is applied on top of ValidatePasswordPlaintext() whenever a password is chosen, but
+// not when logging in, so that tightening the policy never locks existing users out.
+type PasswordPolicy struct {
+	MinLength        int
+	RequireUpper     bool
+	RequireLower     bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	DisallowPersonal bool
+	Breached         *breached.Corpus
+}
+
+// ValidatePasswordPolicy() checks a new password for the user against the policy. A nil
+// policy only applies the basic checks from ValidatePasswordPlaintext().
+func ValidatePasswordPolicy(v *validator.Validator, policy *PasswordPolicy, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+
+	if policy == nil {
+		return
+	}
+
+	v.Check(utf8.RuneCountInString(password) >= policy.MinLength, "password", fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	v.Check(!policy.RequireUpper || hasUpper, "password", "must contain an upper-case letter")
+	v.Check(!policy.RequireLower || hasLower, "password", "must contain a lower-case letter")
+	v.Check(!policy.RequireDigit || hasDigit, "password", "must contain a digit")
+	v.Check(!policy.RequireSymbol || hasSymbol, "password", "must contain a symbol")
+
+	if policy.DisallowPersonal && user != nil {
+		v.Check(!containsPersonalInfo(password, user), "password", "must not contain your name or email address")
+	}
+
+	v.Check(!policy.Breached.Contains(password), "password", "must not be a password that has appeared in a data breach")
+}
+
+// containsPersonalInfo() reports whether the password contains the local part of the
+// user's email address or any part of their name. Very short parts (like initials) are
+// ignored, as they would reject far too many reasonable passwords.
+func containsPersonalInfo(password string, user *User) bool {
+	password = strings.ToLower(password)
+
+	local, _, _ := strings.Cut(user.Email, "@")
+	parts := append(strings.Fields(user.Name), local)
+
+	for _, part := range parts {
+		part = strings.ToLower(part)
+		if utf8.RuneCountInString(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -19,24 +19,45 @@ func (p Permissions) Include(code string) bool {
 	return slices.Contains(p, code)
 }
 
+// The Intersect() method returns the permission codes which appear both in the
+// Permissions slice and in the other one. We use it to restrict what a credential with
+// a limited scope (like an API key) can do on behalf of its owner.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	var permissions Permissions
+
+	for _, code := range p {
+		if other.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
 	DB *sql.DB
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Permissions slice. The result is the union of the permissions granted directly to the
+// user and the permissions bundled in any of the roles assigned to them, so callers
+// don't need to care where a permission came from.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
         INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users.id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -67,14 +88,50 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 // Add the provided permission codes for a specific user. Notice that we're using a
 // variadic parameter for the codes so that we can assign multiple permissions in a
 // single call.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
         SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// The GetAll() method returns every permission code that exists, which is also the set
+// of scopes that OAuth clients can ask for.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+        SELECT code
+        FROM permissions
+        ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
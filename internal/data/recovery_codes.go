@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// Define the number of recovery codes generated for each user when they enable
+// two-factor authentication.
+const recoveryCodeCount = 10
+
+// Define the RecoveryCodeModel type.
+type RecoveryCodeModel struct {
+	DB *sql.DB
+}
+
+// The generateRecoveryCode() function returns a random code formatted as two groups of
+// five characters (like "k3vqx-7mnd2"), which is easy to read and type.
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 10)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	return code[:5] + "-" + code[5:10], nil
+}
+
+// hashRecoveryCode() normalizes a recovery code before hashing it, so that users can
+// type it without the hyphen and in any case.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// The New() method generates a fresh set of recovery codes for a specific user,
+// replacing any codes they had before, and returns their plaintext values. Only the
+// hashes are stored, so this is the only time that the codes can be shown to the user.
+func (m RecoveryCodeModel) New(ctx context.Context, userID int64) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+
+	for range recoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, hashRecoveryCode(code), userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// The Consume() method deletes a recovery code belonging to a specific user, returning
+// false if there was no such code. Deleting it makes sure each code only works once.
+func (m RecoveryCodeModel) Consume(ctx context.Context, userID int64, code string) (bool, error) {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE hash = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// The DeleteAllForUser() method deletes all the recovery codes belonging to a specific
+// user.
+func (m RecoveryCodeModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
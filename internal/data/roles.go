@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define an UnknownRoleError, returned when assigning a role code that doesn't exist,
+// so that the caller can tell the client which code was wrong.
+type UnknownRoleError struct {
+	Code string
+}
+
+func (e *UnknownRoleError) Error() string {
+	return fmt.Sprintf("unknown role %q", e.Code)
+}
+
+// Define a Role struct to hold a named bundle of permission codes (like "viewer" or
+// "editor").
+type Role struct {
+	Code        string      `json:"code"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// The GetAll() method returns all the roles together with the permission codes bundled
+// in each of them.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := `
+        SELECT roles.code, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id
+        GROUP BY roles.id
+        ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.Code, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// The GetAllForUser() method returns the codes of all the roles assigned to a specific
+// user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	query := `
+        SELECT roles.code
+        FROM roles
+        INNER JOIN users_roles ON users_roles.role_id = roles.id
+        WHERE users_roles.user_id = $1
+        ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+
+	for rows.Next() {
+		var role string
+
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Add the provided role codes for a specific user. Like PermissionModel.AddForUser()
+// this uses a variadic parameter so that multiple roles can be assigned in one call.
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+        INSERT INTO users_roles
+        SELECT $1, roles.id FROM roles WHERE roles.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkRoleCodes(ctx, tx, codes)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		switch {
+		case isUsersRolesUserViolation(err):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// The SetForUser() method replaces all the roles assigned to a specific user with the
+// provided role codes. Both statements run in a single transaction so the user never
+// ends up without any of their roles halfway through the change.
+func (m RoleModel) SetForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = checkRoleCodes(ctx, tx, codes)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_roles WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO users_roles
+        SELECT $1, roles.id FROM roles WHERE roles.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		switch {
+		case isUsersRolesUserViolation(err):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// The checkRoleCodes() helper returns an UnknownRoleError for the first of the codes
+// which doesn't match an existing role. Otherwise the INSERT ... SELECT statements above
+// would just skip it.
+func checkRoleCodes(ctx context.Context, tx *sql.Tx, codes []string) error {
+	query := `
+        SELECT code FROM unnest($1::text[]) AS code
+        WHERE code NOT IN (SELECT roles.code FROM roles)
+        LIMIT 1`
+
+	var code string
+
+	err := tx.QueryRowContext(ctx, query, pq.Array(codes)).Scan(&code)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	default:
+		return &UnknownRoleError{Code: code}
+	}
+}
+
+// The isUsersRolesUserViolation() helper reports whether the error is a foreign key
+// violation (SQLSTATE 23503) of the users_roles.user_id column, which means that there
+// is no user with the ID we tried to assign roles to.
+func isUsersRolesUserViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503" && pqErr.Constraint == "users_roles_user_id_fkey"
+}
@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Define the types of security event that we record for each user.
+const (
+	EventLoginSucceeded         = "login_succeeded"
+	EventLoginFailed            = "login_failed"
+	EventPasswordResetRequested = "password_reset_requested"
+	EventPasswordChanged        = "password_changed"
+	EventAccountActivated       = "account_activated"
+	EventTokenRevoked           = "token_revoked"
+	EventAllTokensRevoked       = "all_tokens_revoked"
+	EventTwoFactorDisabled      = "two_factor_disabled"
+)
+
+// Define a SecurityEvent struct to hold a security-relevant action on a user's account,
+// along with the IP address and user agent of the client that performed it. Users can
+// look through their events to spot activity that wasn't theirs.
+type SecurityEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// Define the SecurityEventModel type.
+type SecurityEventModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds a new security event to the security_events table.
+func (m SecurityEventModel) Insert(ctx context.Context, event *SecurityEvent) error {
+	query := `
+        INSERT INTO security_events (user_id, type, ip, user_agent)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at`
+
+	args := []any{event.UserID, event.Type, event.IP, event.UserAgent}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetAllForUser() returns a page of the security events for a specific user, along
+// with the pagination metadata.
+func (m SecurityEventModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*SecurityEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, user_id, type, ip, user_agent
+        FROM security_events
+        WHERE user_id = $1
+        ORDER BY %s %s, id %s
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*SecurityEvent{}
+
+	for rows.Next() {
+		var event SecurityEvent
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.UserID,
+			&event.Type,
+			&event.IP,
+			&event.UserAgent,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// IsNewDevice() reports whether a successful login from the user agent would be the
+// first one from that device, and whether the user has ever logged in before at all.
+// Users who are logging in for the very first time don't need to be told about it.
+func (m SecurityEventModel) IsNewDevice(ctx context.Context, userID int64, userAgent string) (newDevice bool, firstLogin bool, err error) {
+	query := `
+        SELECT count(*), count(*) FILTER (WHERE user_agent = $3)
+        FROM security_events
+        WHERE user_id = $1 AND type = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var logins, fromDevice int
+
+	err = m.DB.QueryRowContext(ctx, query, userID, EventLoginSucceeded, userAgent).Scan(&logins, &fromDevice)
+	if err != nil {
+		return false, false, err
+	}
+
+	return fromDevice == 0, logins == 0, nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/AguilaMike/greenlight/internal/validator"
@@ -17,17 +18,44 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "2fa-pending"
+	ScopeMagicLink      = "magic-link"
+	ScopeInvitation     = "invitation"
+)
+
+// Define a custom ErrTokenReused error. We'll return this when a single-use token
+// (like a refresh token) is presented for a second time. ErrTokenExpired is returned
+// when a token exists but its expiry time has passed.
+var (
+	ErrTokenReused  = errors.New("token reused")
+	ErrTokenExpired = errors.New("token expired")
 )
 
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
-// scope.
+// scope, along with the IP address and user agent of the client it was issued to.
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    string    `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+}
+
+// Define a Session struct to describe an active authentication token to its owner. It
+// never contains the token itself, only the details needed to recognise it.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -72,6 +100,19 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// The NewTokenFamily() function generates a random identifier which is used to link
+// together all the access and refresh tokens descending from a single login.
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // Check that the plaintext token has been provided and is exactly 26 bytes long.
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
@@ -85,40 +126,307 @@ type TokenModel struct {
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
 // data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// The NewForClient() method works like New(), but also records the token family along
+// with the IP address and user agent of the client that the token is being issued to.
+func (m TokenModel) NewForClient(ctx context.Context, userID int64, ttl time.Duration, scope, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert() adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope)
-        VALUES ($1, $2, $3, $4)`
+        INSERT INTO tokens (hash, user_id, expiry, scope, family, ip, user_agent)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.IP, token.UserAgent}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
+// Get() returns the token with a specific scope and plaintext. Unlike the other lookups,
+// which simply ignore expired tokens, it tells the caller about them by returning an
+// ErrTokenExpired error, so that they can give the user a more helpful message. If
+// there is no such token at all we return an ErrRecordNotFound error.
+func (m TokenModel) Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT hash, user_id, expiry, scope, family, ip, user_agent
+        FROM tokens
+        WHERE hash = $1 AND scope = $2`
+
+	var token Token
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Family,
+		&token.IP,
+		&token.UserAgent,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.Plaintext = tokenPlaintext
+
+	if !token.Expiry.After(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	return &token, nil
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
         DELETE FROM tokens
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteExpired() deletes up to batchSize tokens which have passed their expiry time,
+// and returns how many were deleted. Deleting in batches keeps each statement short, so
+// that a large backlog of expired tokens doesn't hold locks on the table for long.
+func (m TokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE hash IN (
+            SELECT hash FROM tokens
+            WHERE expiry < NOW()
+            LIMIT $1
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteWithFamily() deletes a single token, identified by its plaintext value,
+// together with every other token in the same family. This makes sure that logging out
+// also revokes the refresh token which could otherwise be used to log straight back in.
+func (m TokenModel) DeleteWithFamily(ctx context.Context, scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE hash = $2
+        OR family = (SELECT family FROM tokens WHERE scope = $1 AND hash = $2 AND family <> '')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteFamily() deletes all tokens for a specific scope and token family. Tokens
+// issued outside of a family have an empty family, and are never matched.
+func (m TokenModel) DeleteFamily(ctx context.Context, scope, family string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = $1 AND family = $2 AND family <> ''`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, family)
+	return err
+}
+
+// Consume() marks a single-use token as used and returns it. If the token has already
+// been used, we treat it as a replay and delete the whole token family before returning
+// an ErrTokenReused error, so that neither the legitimate client nor the attacker can
+// carry on using it.
+func (m TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT user_id, expiry, scope, family, used_at
+        FROM tokens
+        WHERE scope = $1 AND hash = $2 AND expiry > $3
+        FOR UPDATE`
+
+	token := Token{Hash: tokenHash[:]}
+	var usedAt *time.Time
+
+	err = tx.QueryRowContext(ctx, query, scope, tokenHash[:], time.Now()).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Family,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt != nil {
+		// Tokens issued outside of a family have an empty family, so we must make sure
+		// that we don't match all of them.
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE (family = $1 AND family <> '') OR hash = $2`, token.Family, tokenHash[:])
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = $1 WHERE hash = $2`, time.Now(), tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Touch() records that a token has just been used. To avoid writing to the database on
+// every single request, the last_used_at column is only updated if it is more than a
+// minute old.
+func (m TokenModel) Touch(ctx context.Context, scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        UPDATE tokens
+        SET last_used_at = $3
+        WHERE scope = $1 AND hash = $2
+        AND (last_used_at IS NULL OR last_used_at < $3 - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:], time.Now())
+	return err
+}
+
+// GetAllSessionsForUser() returns the unexpired and unused tokens with the given scope
+// for a specific user, most recent first. The token matching currentTokenPlaintext, or
+// belonging to currentFamily, (if any) is flagged as the current session.
+func (m TokenModel) GetAllSessionsForUser(ctx context.Context, scope string, userID int64, currentTokenPlaintext, currentFamily string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentTokenPlaintext))
+
+	query := `
+        SELECT id, created_at, last_used_at, expiry, ip, user_agent, hash = $3 OR (family = $5 AND family <> '')
+        FROM tokens
+        WHERE user_id = $1 AND scope = $2 AND expiry > $4 AND used_at IS NULL
+        ORDER BY created_at DESC, id DESC`
+
+	args := []any{userID, scope, currentHash[:], time.Now(), currentFamily}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/AguilaMike/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Define a custom ErrDuplicateEmail error.
@@ -21,15 +20,18 @@ var (
 // Define a User struct to represent an individual user. Importantly, notice how we are
 // using the json:"-" struct tag to prevent the Password and Version fields appearing in
 // any output when we encode it to JSON. Also notice that the Password field uses the
-// custom password type defined below.
+// custom password type defined below. The TOTPSecret field holds the encrypted secret
+// used for two-factor authentication, and is never decrypted inside this package.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Password    password  `json:"-"`
+	Activated   bool      `json:"activated"`
+	TOTPSecret  []byte    `json:"-"`
+	TOTPEnabled bool      `json:"two_factor_enabled"`
+	Version     int       `json:"-"`
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -46,10 +48,11 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method hashes a plaintext password with the current hashing settings (see
+// SetPasswordHashing()), and stores both the hash and the plaintext versions in the
+// struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -62,19 +65,16 @@ func (p *password) Set(plaintextPassword string) error {
 
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false
-// otherwise.
+// otherwise. Both bcrypt and argon2id hashes are supported.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return compareHashAndPassword(p.hash, plaintextPassword)
+}
 
-	return true, nil
+// The NeedsRehash() method reports whether the stored hash is out of date with the
+// current hashing settings. After a successful Matches() call we still have the
+// plaintext password, so the hash can be upgraded by calling Set() again.
+func (p *password) NeedsRehash() bool {
+	return needsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -120,7 +120,7 @@ type UserModel struct {
 // version fields are all automatically generated by our database, so we use the
 // RETURNING clause to read them into the User struct after the insert, in the same way
 // that we did when creating a movie.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
         INSERT INTO users (name, email, password_hash, activated)
         VALUES ($1, $2, $3, $4)
@@ -128,7 +128,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try
@@ -148,18 +148,58 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, email, password_hash, activated, totp_secret, totp_enabled, version
+        FROM users
+        WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, password_hash, activated, totp_secret, totp_enabled, version
         FROM users
         WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -169,6 +209,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
 		&user.Version,
 	)
 
@@ -189,11 +231,11 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 // when updating a movie. And we also check for a violation of the "users_email_key"
 // constraint when performing the update, just like we did when inserting the user
 // record originally.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
         UPDATE users
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, password_hash = $3, activated = $4, totp_secret = $5, totp_enabled = $6, version = version + 1
+        WHERE id = $7 AND version = $8
         RETURNING version`
 
 	args := []any{
@@ -201,11 +243,13 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.TOTPSecret,
+		user.TOTPEnabled,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -223,14 +267,41 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// The UseTOTPStep() method records the time step of a TOTP code the user has just
+// presented, returning false if a code for that step (or a later one) has already been
+// used. The check and the update happen in a single statement, so that the same code
+// can't be replayed, even by two requests racing each other. It doesn't change the
+// version number, as it doesn't touch any of the details that Update() saves.
+func (m UserModel) UseTOTPStep(ctx context.Context, userID, step int64) (bool, error) {
+	query := `
+        UPDATE users
+        SET totp_last_step = $2
+        WHERE id = $1 AND totp_last_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	// Set up the SQL query.
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.totp_secret, users.totp_enabled, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -246,7 +317,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching
@@ -258,6 +329,8 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
 		&user.Version,
 	)
 	if err != nil {
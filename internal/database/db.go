@@ -5,15 +5,22 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 
 	"github.com/AguilaMike/greenlight/internal/config"
 )
 
 func OpenDB(cfg *config.Config) (*sql.DB, error) {
-	// Use the sql.Open() function to create a new database handle. This doesn't
-	// establish a connection to the database, it just validates the DSN provided.
-	db, err := sql.Open("postgres", cfg.Db.Dsn)
+	// Use the otelsql.Open() function to create a new database handle. This works
+	// just like sql.Open(), but wraps the driver so that every query made with a context
+	// is recorded as an OpenTelemetry span, as a child of the span in the context. It
+	// doesn't establish a connection to the database, it just validates the DSN provided.
+	db, err := otelsql.Open("postgres", cfg.Db.Dsn,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
 	if err != nil {
 		return nil, err
 	}
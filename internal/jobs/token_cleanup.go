@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/AguilaMike/greenlight/internal/config"
+)
+
+// Publish the token cleanup metrics in the expvar handler, so that we can keep an eye
+// on how many expired tokens are being removed from the database.
+var (
+	tokensPurged      = expvar.NewInt("expired_tokens_purged")
+	tokenCleanupRuns  = expvar.NewInt("token_cleanup_runs")
+	tokenCleanupFails = expvar.NewInt("token_cleanup_failures")
+	idempotencyPurged = expvar.NewInt("expired_idempotency_keys_purged")
+	oidcStatesPurged  = expvar.NewInt("expired_oidc_states_purged")
+	oauthCodesPurged  = expvar.NewInt("expired_oauth_codes_purged")
+	oauthTokensPurged = expvar.NewInt("expired_oauth_tokens_purged")
+)
+
+// The tracer used to record a span for each run of the jobs.
+var tracer = otel.Tracer("github.com/AguilaMike/greenlight/internal/jobs")
+
+// StartTokenCleanup() launches a background job which periodically purges expired
+// tokens, along with expired idempotency keys, OIDC states and OAuth codes and access
+// tokens, from the database. The job runs through the application worker, so it is
+// included in the WaitGroup and the graceful shutdown waits for it to finish the batch
+// it is working on once the context is cancelled.
+func StartTokenCleanup(ctx context.Context, app *config.Application) {
+	cfg := app.Config.TokenCleanup
+
+	if cfg.Interval <= 0 {
+		app.Logger.Info("expired token cleanup disabled")
+		return
+	}
+
+	if cfg.BatchSize < 1 {
+		app.Logger.Error("expired token cleanup disabled: batch size must be at least 1", "batch_size", cfg.BatchSize)
+		return
+	}
+
+	// The worker hands the function a copy of the context without its cancellation, so
+	// we keep using our own context to know when to stop.
+	app.Worker.Background(ctx, func(context.Context) {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			purgeExpiredTokens(ctx, app, cfg.BatchSize)
+			purgeExpired(ctx, app, "idempotency keys", cfg.BatchSize, idempotencyPurged, app.Models.IdempotencyKeys.DeleteExpired)
+			purgeExpired(ctx, app, "oidc states", cfg.BatchSize, oidcStatesPurged, app.Models.OIDCStates.DeleteExpired)
+			purgeExpired(ctx, app, "oauth codes", cfg.BatchSize, oauthCodesPurged, app.Models.OAuthCodes.DeleteExpired)
+			purgeExpired(ctx, app, "oauth tokens", cfg.BatchSize, oauthTokensPurged, app.Models.OAuthTokens.DeleteExpired)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// The purgeExpiredTokens() helper deletes expired tokens in batches until there are
+// none left, or until the context is cancelled.
+func purgeExpiredTokens(ctx context.Context, app *config.Application, batchSize int) {
+	// Record each run as its own trace, with the delete queries as its children.
+	ctx, span := tracer.Start(ctx, "jobs.purgeExpiredTokens")
+	defer span.End()
+
+	tokenCleanupRuns.Add(1)
+
+	var total int64
+
+	for ctx.Err() == nil {
+		deleted, err := app.Models.Tokens.DeleteExpired(ctx, batchSize)
+		if err != nil {
+			span.RecordError(err)
+			tokenCleanupFails.Add(1)
+			app.Logger.Error("expired token cleanup failed", "error", err.Error(), "deleted", total)
+			return
+		}
+
+		total += deleted
+		tokensPurged.Add(deleted)
+
+		if deleted < int64(batchSize) {
+			break
+		}
+	}
+
+	span.SetAttributes(attribute.Int64("tokens.deleted", total))
+
+	if total > 0 {
+		app.Logger.Info("expired tokens purged", "deleted", total)
+	}
+}
+
+// The purgeExpired() helper deletes the expired rows of a table, using its model's
+// deleteExpired method, in batches until there are none left, or until the context is
+// cancelled. The name describes the rows in the span and the log entries.
+func purgeExpired(ctx context.Context, app *config.Application, name string, batchSize int, purged *expvar.Int, deleteExpired func(context.Context, int) (int64, error)) {
+	ctx, span := tracer.Start(ctx, "jobs.purgeExpired", trace.WithAttributes(attribute.String("purge.rows", name)))
+	defer span.End()
+
+	var total int64
+
+	for ctx.Err() == nil {
+		deleted, err := deleteExpired(ctx, batchSize)
+		if err != nil {
+			span.RecordError(err)
+			app.Logger.Error("expired "+name+" cleanup failed", "error", err.Error(), "deleted", total)
+			return
+		}
+
+		total += deleted
+		purged.Add(deleted)
+
+		if deleted < int64(batchSize) {
+			break
+		}
+	}
+
+	span.SetAttributes(attribute.Int64("purge.deleted", total))
+
+	if total > 0 {
+		app.Logger.Info("expired "+name+" purged", "deleted", total)
+	}
+}
@@ -2,11 +2,18 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"html/template"
 	"time"
 
 	"github.com/go-mail/mail/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/AguilaMike/greenlight/internal/metrics"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold
@@ -18,6 +25,9 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+// The tracer used to record a span for each email sent.
+var tracer = otel.Tracer("github.com/AguilaMike/greenlight/internal/mailer")
+
 // Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
 // SMTP server) and the sender information for your emails (the name and address you
 // want the email to be from, such as "Alice Smith <alice@example.com>").
@@ -42,7 +52,24 @@ func New(host string, port int, username, password, sender string) Mailer {
 // Define a Send() method on the Mailer type. This takes the recipient email address
 // as the first parameter, the name of the file containing the templates, and any
 // dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+//
+// Each email is recorded as an OpenTelemetry span, as a child of the span in the
+// context, so it shows up in the trace of the request that sent it.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data any) (err error) {
+	_, span := tracer.Start(ctx, "mailer.Send", trace.WithAttributes(attribute.String("mailer.template", templateFile)))
+
+	// Count every email we try to send in the metrics, by template and result, and
+	// record any error on the span.
+	defer func() {
+		metrics.RecordMail(templateFile, err)
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
@@ -102,5 +129,5 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	return nil
+	return err
 }
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every Prometheus collector of the application. We use our own
+// registry rather than the global default one, so that only the metrics we register
+// here are exposed.
+var Registry = prometheus.NewRegistry()
+
+// Define the collectors for the metrics exposed at GET /metrics. Requests are labelled
+// with the httprouter route pattern (such as /v1/movies/:id) rather than the raw path,
+// to keep the number of series under control.
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "greenlight",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	HTTPRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "greenlight",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being handled.",
+	})
+
+	RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "rate_limit_rejections_total",
+		Help:      "Total number of requests rejected by the rate limiter, by route group.",
+	}, []string{"group"})
+
+	MailSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "greenlight",
+		Name:      "mailer_sends_total",
+		Help:      "Total number of emails sent, by template and result (success or failure).",
+	}, []string{"template", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		HTTPRequests,
+		HTTPRequestDuration,
+		HTTPRequestsInFlight,
+		RateLimitRejections,
+		MailSends,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// RegisterDB() adds the statistics of the database connection pool to the registry.
+func RegisterDB(db *sql.DB) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, "greenlight"))
+}
+
+// RecordMail() counts an attempt to send an email with the template, as a success if
+// err is nil and as a failure otherwise.
+func RecordMail(templateFile string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	MailSends.WithLabelValues(templateFile, result).Inc()
+}
+
+// Handler() returns an http.Handler which serves the metrics in the Prometheus text
+// exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
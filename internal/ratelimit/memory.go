@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store which keeps the theoretical arrival times in a map in the
+// memory of the current process. It is fast and needs no other services, but every
+// replica of the application keeps its own limits, so it is only suitable when running
+// a single instance.
+type MemoryStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+}
+
+// NewMemoryStore() returns a new MemoryStore and launches a background goroutine which
+// removes the keys whose bucket is full again once every minute, as they hold no state
+// worth keeping.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		tats: make(map[string]time.Time),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			now := time.Now()
+
+			s.mu.Lock()
+			for key, tat := range s.tats {
+				if tat.Before(now) {
+					delete(s.tats, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}()
+
+	return s
+}
+
+// Allow() implements the Store interface.
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, tat := gcra(time.Now(), s.tats[key], limit)
+	if result.Allowed {
+		s.tats[key] = tat
+	}
+
+	return result, nil
+}
@@ -0,0 +1,10 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(), time.Sleep)
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// Define a Limit struct to hold the rate at which requests are allowed (in requests per
+// second) and the maximum burst of requests which can be made at once.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Validate() returns an error if the limit can't be enforced: the rate must be above 0
+// (and no more than a million requests per second, as the stores work in
+// microseconds), and the burst must be at least 1.
+func (l Limit) Validate() error {
+	switch {
+	case !(l.Rate > 0):
+		return errors.New("rate must be greater than 0")
+	case l.Rate > 1_000_000:
+		return errors.New("rate must not be more than 1000000")
+	case l.Burst < 1:
+		return errors.New("burst must be at least 1")
+	default:
+		return nil
+	}
+}
+
+// The emissionInterval() method returns the time it takes for one request to be
+// replenished.
+func (l Limit) emissionInterval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// Define a Result struct to hold the outcome of a rate limit check. Remaining is the
+// number of requests which can still be made straight away, RetryAfter is how long the
+// client must wait before its next request is allowed (zero if this request was
+// allowed), and ResetAfter is how long it takes until the full burst is available again.
+type Result struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// Store is the interface implemented by the rate limiter backends. Allow() checks
+// whether a request identified by the key is allowed under the limit, and records it if
+// it is. Every replica of the application must share the same store for the limits to
+// apply across the whole deployment.
+//
+// Both implementations use the generic cell rate algorithm (GCRA), which only needs to
+// store a single timestamp per key: the theoretical arrival time (TAT) at which the
+// key's bucket would be full again.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// The gcra() function applies the generic cell rate algorithm to a request made at now,
+// given the stored theoretical arrival time for the key (the zero time if there is
+// none). It returns the result of the check and the new theoretical arrival time to
+// store if the request is allowed.
+func gcra(now, tat time.Time, limit Limit) (Result, time.Time) {
+	emission := limit.emissionInterval()
+	burstOffset := emission * time.Duration(limit.Burst)
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(emission)
+	allowAt := newTAT.Add(-burstOffset)
+	diff := now.Sub(allowAt)
+
+	if diff < 0 {
+		return Result{
+			Allowed:    false,
+			Limit:      limit,
+			Remaining:  0,
+			RetryAfter: -diff,
+			ResetAfter: tat.Sub(now),
+		}, tat
+	}
+
+	return Result{
+		Allowed:    true,
+		Limit:      limit,
+		Remaining:  int(math.Floor(float64(diff) / float64(emission))),
+		ResetAfter: newTAT.Sub(now),
+	}, newTAT
+}
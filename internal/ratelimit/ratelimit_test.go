@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		tat     time.Time
+		limit   Limit
+		want    Result
+		wantTAT time.Time
+	}{
+		{
+			name:    "First request",
+			tat:     time.Time{},
+			limit:   Limit{Rate: 1, Burst: 3},
+			want:    Result{Allowed: true, Limit: Limit{Rate: 1, Burst: 3}, Remaining: 2, ResetAfter: time.Second},
+			wantTAT: now.Add(time.Second),
+		},
+		{
+			name:    "Bucket full again",
+			tat:     now.Add(-10 * time.Second),
+			limit:   Limit{Rate: 1, Burst: 3},
+			want:    Result{Allowed: true, Limit: Limit{Rate: 1, Burst: 3}, Remaining: 2, ResetAfter: time.Second},
+			wantTAT: now.Add(time.Second),
+		},
+		{
+			name:    "Last request of the burst",
+			tat:     now.Add(2 * time.Second),
+			limit:   Limit{Rate: 1, Burst: 3},
+			want:    Result{Allowed: true, Limit: Limit{Rate: 1, Burst: 3}, Remaining: 0, ResetAfter: 3 * time.Second},
+			wantTAT: now.Add(3 * time.Second),
+		},
+		{
+			name:    "Burst exhausted",
+			tat:     now.Add(3 * time.Second),
+			limit:   Limit{Rate: 1, Burst: 3},
+			want:    Result{Allowed: false, Limit: Limit{Rate: 1, Burst: 3}, RetryAfter: time.Second, ResetAfter: 3 * time.Second},
+			wantTAT: now.Add(3 * time.Second),
+		},
+		{
+			name:    "Not yet replenished",
+			tat:     now.Add(2500 * time.Millisecond),
+			limit:   Limit{Rate: 1, Burst: 3},
+			want:    Result{Allowed: false, Limit: Limit{Rate: 1, Burst: 3}, RetryAfter: 500 * time.Millisecond, ResetAfter: 2500 * time.Millisecond},
+			wantTAT: now.Add(2500 * time.Millisecond),
+		},
+		{
+			name:    "Fractional rate",
+			tat:     time.Time{},
+			limit:   Limit{Rate: 0.5, Burst: 1},
+			want:    Result{Allowed: true, Limit: Limit{Rate: 0.5, Burst: 1}, Remaining: 0, ResetAfter: 2 * time.Second},
+			wantTAT: now.Add(2 * time.Second),
+		},
+		{
+			name:    "Fractional rate exhausted",
+			tat:     now.Add(2 * time.Second),
+			limit:   Limit{Rate: 0.5, Burst: 1},
+			want:    Result{Allowed: false, Limit: Limit{Rate: 0.5, Burst: 1}, RetryAfter: 2 * time.Second, ResetAfter: 2 * time.Second},
+			wantTAT: now.Add(2 * time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotTAT := gcra(now, tt.tat, tt.limit)
+
+			if got != tt.want {
+				t.Errorf("gcra() result = %+v; want %+v", got, tt.want)
+			}
+
+			if !gotTAT.Equal(tt.wantTAT) {
+				t.Errorf("gcra() tat = %v; want %v", gotTAT, tt.wantTAT)
+			}
+		})
+	}
+}
+
+func TestLimitValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   Limit
+		wantErr bool
+	}{
+		{name: "Valid", limit: Limit{Rate: 2, Burst: 4}},
+		{name: "Fractional rate", limit: Limit{Rate: 0.2, Burst: 1}},
+		{name: "Zero rate", limit: Limit{Rate: 0, Burst: 4}, wantErr: true},
+		{name: "Negative rate", limit: Limit{Rate: -1, Burst: 4}, wantErr: true},
+		{name: "Rate too high", limit: Limit{Rate: 2_000_000, Burst: 4}, wantErr: true},
+		{name: "Zero burst", limit: Limit{Rate: 2, Burst: 0}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limit.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The testStore() helper checks that a store lets a burst of requests through, rejects
+// the next one until the key's bucket has been partly replenished, and keeps separate
+// limits for each key. The advance function moves the store's clock forward.
+func testStore(t *testing.T, store Store, advance func(time.Duration)) {
+	t.Helper()
+
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i, wantRemaining := range []int{2, 1, 0} {
+		result, err := store.Allow(ctx, "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !result.Allowed || result.Remaining != wantRemaining {
+			t.Fatalf("request %d: got %+v; want allowed with %d remaining", i+1, result, wantRemaining)
+		}
+	}
+
+	result, err := store.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Fatalf("request 4: got %+v; want rejected with a retry after of up to 1s", result)
+	}
+
+	result, err = store.Allow(ctx, "another-client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Allowed {
+		t.Fatalf("another client: got %+v; want allowed", result)
+	}
+
+	advance(time.Second)
+
+	result, err = store.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Allowed {
+		t.Fatalf("after a second: got %+v; want allowed", result)
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The gcraScript applies the generic cell rate algorithm atomically inside Redis, so
+// that concurrent requests hitting different replicas can't both spend the same
+// capacity. It uses the Redis server clock rather than the clock of each replica, and
+// works in microseconds. The new theoretical arrival time is formatted explicitly, as
+// Lua would otherwise convert large numbers to strings in exponent notation and lose
+// precision. Keys expire once their bucket is full again.
+//
+// The script returns {allowed, remaining, retry after, reset after}.
+var gcraScript = redis.NewScript(`
+local emission = tonumber(ARGV[1])
+local burst_offset = tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+    tat = now
+end
+
+local new_tat = tat + emission
+local diff = now - (new_tat - burst_offset)
+
+if diff < 0 then
+    return {0, 0, -diff, tat - now}
+end
+
+redis.call("SET", KEYS[1], string.format("%.0f", new_tat), "PX", math.ceil((new_tat - now) / 1000))
+
+return {1, math.floor(diff / emission), 0, new_tat - now}
+`)
+
+// RedisStore is a Store which keeps the theoretical arrival times in Redis (or any
+// server compatible with its scripting commands, version 5 or later), so that the limits
+// are shared by every replica of the application.
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisStore() returns a new RedisStore which stores its keys in the client with the
+// given prefix.
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Allow() implements the Store interface.
+func (s *RedisStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	emission := limit.emissionInterval()
+	burstOffset := emission * time.Duration(limit.Burst)
+
+	values, err := gcraScript.Run(ctx, s.client, []string{s.prefix + key}, emission.Microseconds(), burstOffset.Microseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
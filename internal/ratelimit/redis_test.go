@@ -0,0 +1,33 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	// The script reads the time from Redis, so we control the clock through miniredis.
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	mr.SetTime(now)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	store := NewRedisStore(client, "test:")
+
+	testStore(t, store, func(d time.Duration) {
+		now = now.Add(d)
+		mr.SetTime(now)
+	})
+
+	// The key must expire once the bucket is full again, so that idle clients don't
+	// take up memory.
+	if ttl := mr.TTL("test:client"); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("TTL = %v; want between 0 and 3s", ttl)
+	}
+}
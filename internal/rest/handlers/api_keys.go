@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+type APIKeyHandler struct {
+	AppHandler
+}
+
+func NewAPIKeyHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
+	return &APIKeyHandler{
+		AppHandler: AppHandler{
+			app:        app,
+			apiVersion: config.API_VERSION,
+			areaName:   "users/me/api-keys",
+			mid:        mid,
+		},
+	}
+}
+
+func (ah *APIKeyHandler) SetRoutes(r *httprouter.Router) {
+	r.HandlerFunc(http.MethodGet, ah.getURLPattern(ah.areaName), ah.mid.RequireActivatedUser(ah.mid.RequireFirstParty(ah.listAPIKeysHandler)))
+	r.HandlerFunc(http.MethodPost, ah.getURLPattern(ah.areaName), ah.mid.RequireActivatedUser(ah.mid.RequireFirstParty(ah.createAPIKeyHandler)))
+	r.HandlerFunc(http.MethodDelete, ah.getURLPattern(ah.areaName+"/:id"), ah.mid.RequireActivatedUser(ah.mid.RequireFirstParty(ah.deleteAPIKeyHandler)))
+}
+
+// Show all the API keys belonging to the user making the request. The keys themselves
+// are never included, as we only store their hashes.
+func (ah *APIKeyHandler) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.ContextGetUser(r)
+
+	keys, err := ah.app.Models.APIKeys.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"api_keys": keys}, nil, ah.app.Config.Env.String())
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Create a new API key for the user making the request, restricted to a subset of the
+// permissions that the user currently has.
+func (ah *APIKeyHandler) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		ah.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	user := middlewares.ContextGetUser(r)
+
+	permissions, err := ah.app.Models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+
+	v := validator.New()
+
+	data.ValidateAPIKey(v, key)
+	for _, code := range key.Permissions {
+		v.Check(permissions.Include(code), "permissions", "must only contain permissions that you have")
+	}
+
+	if !v.Valid() {
+		ah.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key, err = ah.app.Models.APIKeys.New(r.Context(), user.ID, key.Name, key.Permissions, key.Expiry)
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only time that the plaintext key is sent to the client.
+	err = helper.WriteJSON(w, http.StatusCreated, helper.Envelope{"api_key": key}, nil, ah.app.Config.Env.String())
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Delete a specific API key belonging to the user making the request.
+func (ah *APIKeyHandler) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := helper.ReadParamFromRequest[int64](r, "id")
+	if err != nil || id < 1 {
+		ah.app.Errors.NotFoundResponse(w, r)
+		return
+	}
+
+	user := middlewares.ContextGetUser(r)
+
+	err = ah.app.Models.APIKeys.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			ah.app.Errors.NotFoundResponse(w, r)
+		default:
+			ah.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "API key successfully deleted"}, nil, ah.app.Config.Env.String())
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
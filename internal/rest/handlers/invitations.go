@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+type InvitationHandler struct {
+	AppHandler
+}
+
+func NewInvitationHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
+	return &InvitationHandler{
+		AppHandler: AppHandler{
+			app:        app,
+			apiVersion: config.API_VERSION,
+			areaName:   "invitations",
+			mid:        mid,
+		},
+	}
+}
+
+func (ih *InvitationHandler) SetRoutes(r *httprouter.Router) {
+	r.HandlerFunc(http.MethodPost, ih.getURLPattern(ih.areaName), ih.mid.RequirePermission(permissionUsersWrite, ih.mid.RequireFirstParty(ih.createInvitationHandler)))
+	r.HandlerFunc(http.MethodPost, ih.getURLPattern(ih.areaName+"/redeem"), ih.mid.RequireFirstParty(ih.redeemInvitationHandler))
+}
+
+// Invite someone to sign up by emailing them a single-use invitation token. The new
+// account will start with the given permissions, which must be a subset of the
+// inviter's own, or just "movies:read" if none are given.
+func (ih *InvitationHandler) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string   `json:"email"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		ih.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	if len(input.Permissions) == 0 {
+		input.Permissions = []string{permissionReadOnly}
+	}
+
+	// The inviter can only hand out permissions that they can use themselves, otherwise
+	// anyone allowed to invite users could mint an account more powerful than their own.
+	permissions, err := ih.mid.EffectivePermissions(r)
+	if err != nil {
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(permissions.Include(code), "permissions", "must only contain permissions that you have")
+	}
+
+	if !v.Valid() {
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// There is no point inviting someone who already has an account.
+	_, err = ih.app.Models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	inviter := middlewares.ContextGetUser(r)
+
+	invitation, err := ih.app.Models.Invitations.New(r.Context(), inviter.ID, ih.app.Config.Registration.InvitationTTL, input.Email, input.Permissions)
+	if err != nil {
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	ih.app.Worker.Background(r.Context(), func(ctx context.Context) {
+		data := map[string]any{
+			"invitationToken": invitation.Token.Plaintext,
+			"expiry":          invitation.Expiry.UTC().Format("2 January 2006"),
+		}
+
+		err := ih.app.Mailer.Send(ctx, invitation.Email, "token_invitation.tmpl", data)
+		if err != nil {
+			ih.app.Logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	err = helper.WriteJSON(w, http.StatusAccepted, helper.Envelope{"invitation": invitation}, nil, ih.app.Config.Env.String())
+	if err != nil {
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Redeem an invitation token, creating an activated user for the invited email address
+// with the permissions chosen by whoever sent the invitation. This works even when open
+// registration is disabled.
+func (ih *InvitationHandler) redeemInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Name           string `json:"name"`
+		Password       string `json:"password"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		ih.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := ih.app.Models.Tokens.Get(r.Context(), data.ScopeInvitation, input.TokenPlaintext)
+	if err == nil {
+		var invitation *data.Invitation
+
+		invitation, err = ih.app.Models.Invitations.GetForToken(r.Context(), token)
+		if err == nil {
+			ih.createInvitedUser(w, r, invitation, input.Name, input.Password)
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, data.ErrTokenExpired):
+		v.AddError("token", "invitation has expired, please ask for a new one")
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrRecordNotFound):
+		v.AddError("token", "invalid invitation token")
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+	default:
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// The createInvitedUser() helper creates the user for a valid invitation and deletes the
+// invitation, so that it can't be redeemed again.
+func (ih *InvitationHandler) createInvitedUser(w http.ResponseWriter, r *http.Request, invitation *data.Invitation, name, password string) {
+	// The invitation proves that the user owns the email address, so there is no need
+	// to send them an activation token.
+	user := &data.User{
+		Name:      name,
+		Email:     invitation.Email,
+		Activated: true,
+	}
+
+	err := user.Password.Set(password)
+	if err != nil {
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateUser(v, user)
+	data.ValidatePasswordPolicy(v, ih.app.PasswordPolicy, password, user)
+
+	if !v.Valid() {
+		ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = ih.app.Models.Invitations.Redeem(r.Context(), invitation, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid invitation token")
+			ih.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		default:
+			ih.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusCreated, helper.Envelope{"user": user}, nil, ih.app.Config.Env.String())
+	if err != nil {
+		ih.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
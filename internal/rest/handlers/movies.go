@@ -38,7 +38,7 @@ func NewMovieHandler(app *config.Application, mid *middlewares.AppMiddleware) ha
 func (m *MovieHandler) SetRoutes(r *httprouter.Router) {
 
 	r.HandlerFunc(http.MethodGet, m.getURLPattern(m.areaName), m.mid.RequirePermission(permissionReadOnly, m.listMoviesHandler))
-	r.HandlerFunc(http.MethodPost, m.getURLPattern(m.areaName), m.mid.RequirePermission(permissionWrite, m.createMovieHandler))
+	r.HandlerFunc(http.MethodPost, m.getURLPattern(m.areaName), m.mid.RequirePermission(permissionWrite, m.mid.Idempotency(m.createMovieHandler)))
 	r.HandlerFunc(http.MethodGet, m.getURLPattern(m.areaName+"/:id"), m.mid.RequirePermission(permissionReadOnly, m.showMovieHandler))
 	r.HandlerFunc(http.MethodPatch, m.getURLPattern(m.areaName+"/:id"), m.mid.RequirePermission(permissionWrite, m.updateMovieHandler))
 	r.HandlerFunc(http.MethodDelete, m.getURLPattern(m.areaName+"/:id"), m.mid.RequirePermission(permissionWrite, m.deleteMovieHandler))
@@ -150,7 +150,7 @@ func (m *MovieHandler) listMoviesHandler(w http.ResponseWriter, r *http.Request)
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
 	// Accept the metadata struct as a return value.
-	movies, metadata, err := m.app.Models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := m.app.Models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.Filters)
 	if err != nil {
 		m.app.Errors.ServerErrorResponse(w, r, err)
 		return
@@ -176,7 +176,7 @@ func (m *MovieHandler) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := m.app.Models.Movies.Get(id)
+	movie, err := m.app.Models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -204,7 +204,7 @@ func (m *MovieHandler) createMovieHandler(w http.ResponseWriter, r *http.Request
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err := m.app.Models.Movies.Insert(movie)
+	err := m.app.Models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		m.app.Errors.ServerErrorResponse(w, r, err)
 		return
@@ -235,7 +235,7 @@ func (m *MovieHandler) updateMovieHandler(w http.ResponseWriter, r *http.Request
 
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := m.app.Models.Movies.Get(id)
+	movie, err := m.app.Models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -262,7 +262,7 @@ func (m *MovieHandler) updateMovieHandler(w http.ResponseWriter, r *http.Request
 	// Pass the updated movie record to our new Update() method.
 	// Intercept any ErrEditConflict error and call the new editConflictResponse()
 	// helper.
-	err = m.app.Models.Movies.Update(movie)
+	err = m.app.Models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -290,7 +290,7 @@ func (m *MovieHandler) deleteMovieHandler(w http.ResponseWriter, r *http.Request
 
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = m.app.Models.Movies.Delete(id)
+	err = m.app.Models.Movies.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
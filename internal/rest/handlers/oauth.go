@@ -0,0 +1,527 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+// Define the OAuth 2.0 grant types that the token endpoint supports.
+const (
+	grantAuthorizationCode = "authorization_code"
+	grantClientCredentials = "client_credentials"
+)
+
+type OAuthHandler struct {
+	AppHandler
+}
+
+func NewOAuthHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
+	return &OAuthHandler{
+		AppHandler: AppHandler{
+			app:        app,
+			apiVersion: config.API_VERSION,
+			areaName:   "oauth",
+			mid:        mid,
+		},
+	}
+}
+
+func (oh *OAuthHandler) SetRoutes(r *httprouter.Router) {
+	r.HandlerFunc(http.MethodGet, oh.getURLPattern(oh.areaName+"/clients"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.listClientsHandler)))
+	r.HandlerFunc(http.MethodPost, oh.getURLPattern(oh.areaName+"/clients"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.createClientHandler)))
+	r.HandlerFunc(http.MethodDelete, oh.getURLPattern(oh.areaName+"/clients/:id"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.deleteClientHandler)))
+	r.HandlerFunc(http.MethodGet, oh.getURLPattern(oh.areaName+"/authorize"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.showAuthorizationHandler)))
+	r.HandlerFunc(http.MethodPost, oh.getURLPattern(oh.areaName+"/authorize"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.authorizeHandler)))
+	r.HandlerFunc(http.MethodDelete, oh.getURLPattern(oh.areaName+"/consents/:id"), oh.mid.RequireActivatedUser(oh.mid.RequireFirstParty(oh.revokeConsentHandler)))
+	r.HandlerFunc(http.MethodPost, oh.getURLPattern(oh.areaName+"/token"), oh.tokenHandler)
+}
+
+// Show the OAuth clients registered by the user making the request.
+func (oh *OAuthHandler) listClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.ContextGetUser(r)
+
+	clients, err := oh.app.Models.OAuthClients.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"clients": clients}, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Register a new third-party application. The scopes are the permission codes that the
+// application may ask users to grant it.
+func (oh *OAuthHandler) createClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		oh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	permissions, err := oh.app.Models.Permissions.GetAll(r.Context())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		UserID:       middlewares.ContextGetUser(r).ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+	}
+
+	v := validator.New()
+
+	data.ValidateOAuthClient(v, client)
+	for _, scope := range client.Scopes {
+		v.Check(permissions.Include(scope), "scopes", "must only contain existing permission codes")
+	}
+
+	if !v.Valid() {
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = oh.app.Models.OAuthClients.New(r.Context(), client)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only time that the client secret is sent to the client.
+	err = helper.WriteJSON(w, http.StatusCreated, helper.Envelope{"client": client}, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Delete a client registered by the user making the request, which also revokes every
+// consent and access token issued to it.
+func (oh *OAuthHandler) deleteClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := helper.ReadParamFromRequest[string](r, "id")
+	if err != nil {
+		oh.app.Errors.NotFoundResponse(w, r)
+		return
+	}
+
+	err = oh.app.Models.OAuthClients.Delete(r.Context(), id, middlewares.ContextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			oh.app.Errors.NotFoundResponse(w, r)
+		default:
+			oh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "client successfully deleted"}, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Define an authorizationRequest struct to hold the parameters of an authorization
+// request, as defined by RFC 6749 and RFC 7636 (PKCE).
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// The validateAuthorizationRequest() helper checks an authorization request on behalf
+// of the user, returning the client and the scopes that would be granted to it. These
+// are the requested scopes (or all of the client's scopes, if none were requested)
+// which the user actually has. The redirect URI can be left out if the client has only
+// registered one.
+func (oh *OAuthHandler) validateAuthorizationRequest(ctx context.Context, v *validator.Validator, req *authorizationRequest, user *data.User) (*data.OAuthClient, data.Permissions, error) {
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	v.Check(len(req.CodeChallenge) == 43, "code_challenge", "must be a base64url-encoded SHA-256 hash")
+
+	if !v.Valid() {
+		return nil, nil, nil
+	}
+
+	client, err := oh.app.Models.OAuthClients.Get(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			v.AddError("client_id", "must be a registered client")
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+
+	v.Check(client.AllowsRedirectURI(req.RedirectURI), "redirect_uri", "must be registered for the client")
+
+	requested := data.Permissions(strings.Fields(req.Scope))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+
+	for _, scope := range requested {
+		v.Check(client.Scopes.Include(scope), "scope", "must only contain scopes registered for the client")
+	}
+
+	if !v.Valid() {
+		return nil, nil, nil
+	}
+
+	permissions, err := oh.app.Models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopes := requested.Intersect(permissions)
+
+	v.Check(len(scopes) > 0, "scope", "must contain at least one scope that you have")
+
+	return client, scopes, nil
+}
+
+// Show the details of an authorization request, so that the user can be asked for their
+// consent. If the user has already granted all of the scopes to the client, there is no
+// need to ask them again.
+func (oh *OAuthHandler) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := &authorizationRequest{
+		ResponseType:        qs.Get("response_type"),
+		ClientID:            qs.Get("client_id"),
+		RedirectURI:         qs.Get("redirect_uri"),
+		Scope:               qs.Get("scope"),
+		State:               qs.Get("state"),
+		CodeChallenge:       qs.Get("code_challenge"),
+		CodeChallengeMethod: qs.Get("code_challenge_method"),
+	}
+
+	user := middlewares.ContextGetUser(r)
+	v := validator.New()
+
+	client, scopes, err := oh.validateAuthorizationRequest(r.Context(), v, req, user)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	granted, err := oh.app.Models.OAuthConsents.Get(r.Context(), user.ID, client.ID)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env := helper.Envelope{
+		"client":           helper.Envelope{"client_id": client.ID, "name": client.Name},
+		"scopes":           scopes,
+		"consent_required": len(scopes.Intersect(granted)) != len(scopes),
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, env, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Approve an authorization request on behalf of the user making the request. This
+// records their consent and returns the URI that they should be redirected back to,
+// which carries a short-lived authorization code for the client.
+func (oh *OAuthHandler) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req authorizationRequest
+
+	err := helper.ReadJSON(w, r, &req)
+	if err != nil {
+		oh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	user := middlewares.ContextGetUser(r)
+	v := validator.New()
+
+	// Remember whether the client sent a redirect URI before it is filled in with the
+	// registered one.
+	redirectURIProvided := req.RedirectURI != ""
+
+	client, scopes, err := oh.validateAuthorizationRequest(r.Context(), v, &req, user)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = oh.app.Models.OAuthConsents.Grant(r.Context(), user.ID, client.ID, scopes)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	code := &data.OAuthCode{
+		ClientID:            client.ID,
+		UserID:              user.ID,
+		RedirectURI:         req.RedirectURI,
+		RedirectURIProvided: redirectURIProvided,
+		Scopes:              scopes,
+		CodeChallenge:       req.CodeChallenge,
+		Expiry:              time.Now().Add(10 * time.Minute),
+	}
+
+	err = oh.app.Models.OAuthCodes.Insert(r.Context(), code)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// The redirect URI has already been checked against the registered ones, so it is
+	// a valid absolute URI.
+	redirectURI, _ := url.Parse(req.RedirectURI)
+
+	params := redirectURI.Query()
+	params.Set("code", code.Plaintext)
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	redirectURI.RawQuery = params.Encode()
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"redirect_uri": redirectURI.String()}, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the consent that the user making the request has given to a client, along
+// with the access tokens that the client holds for them.
+func (oh *OAuthHandler) revokeConsentHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, err := helper.ReadParamFromRequest[string](r, "id")
+	if err != nil {
+		oh.app.Errors.NotFoundResponse(w, r)
+		return
+	}
+
+	err = oh.app.Models.OAuthConsents.Revoke(r.Context(), middlewares.ContextGetUser(r).ID, clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			oh.app.Errors.NotFoundResponse(w, r)
+		default:
+			oh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "consent successfully revoked"}, nil, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Issue an access token to a client. Unlike the rest of the API, the token endpoint
+// follows RFC 6749 to the letter (form-encoded requests, and errors in the OAuth
+// format), so that standard OAuth client libraries can talk to it.
+func (oh *OAuthHandler) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		oh.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body could not be parsed")
+		return
+	}
+
+	client, ok := oh.authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="greenlight"`)
+		oh.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	var (
+		userID int64
+		scopes data.Permissions
+	)
+
+	switch r.PostForm.Get("grant_type") {
+	case grantAuthorizationCode:
+		code, err := oh.app.Models.OAuthCodes.Consume(r.Context(), r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				oh.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			default:
+				oh.app.Errors.ServerErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// The redirect URI must match the one the code was issued for if it was sent
+		// with the authorization request. Otherwise it can be left out, but if it is
+		// sent it must still match.
+		redirectURI := r.PostForm.Get("redirect_uri")
+		redirectURIMismatch := (code.RedirectURIProvided || redirectURI != "") && redirectURI != code.RedirectURI
+
+		if code.ClientID != client.ID || redirectURIMismatch || !verifyCodeChallenge(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+			oh.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			return
+		}
+
+		userID, scopes = code.UserID, code.Scopes
+
+	case grantClientCredentials:
+		// A client acting on its own behalf must be able to prove who it is, so only
+		// confidential clients can use this grant. Its tokens act on behalf of the user
+		// who registered it.
+		if !client.Confidential {
+			oh.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+			return
+		}
+
+		scopes = data.Permissions(strings.Fields(r.PostForm.Get("scope")))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+
+		if len(scopes.Intersect(client.Scopes)) != len(scopes) {
+			oh.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the requested scope is not registered for the client")
+			return
+		}
+
+		userID = client.UserID
+
+	default:
+		oh.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "the grant type is not supported")
+		return
+	}
+
+	ttl := oh.app.Config.OAuth.AccessTokenTTL
+
+	token, err := oh.app.Models.OAuthTokens.New(r.Context(), client.ID, userID, scopes, ttl)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env := helper.Envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        strings.Join(token.Scopes, " "),
+	}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	err = helper.WriteJSON(w, http.StatusOK, env, headers, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// The authenticateClient() helper identifies the client making a token request, using
+// either HTTP Basic authentication or the client_id and client_secret form parameters.
+// Confidential clients must present their secret; public clients must not have one.
+func (oh *OAuthHandler) authenticateClient(r *http.Request) (*data.OAuthClient, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 requires the credentials to be form-encoded before they are put in
+		// the Authorization header.
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			return nil, false
+		}
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		return nil, false
+	}
+
+	client, err := oh.app.Models.OAuthClients.Get(r.Context(), clientID)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			oh.app.Logger.ErrorContext(r.Context(), err.Error())
+		}
+		return nil, false
+	}
+
+	if client.Confidential {
+		return client, client.SecretMatches(secret)
+	}
+
+	return client, secret == ""
+}
+
+// The oauthErrorResponse() helper sends an error response in the format defined by
+// RFC 6749, which OAuth client libraries know how to read.
+func (oh *OAuthHandler) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	env := helper.Envelope{
+		"error":             code,
+		"error_description": description,
+	}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	err := helper.WriteJSON(w, status, env, headers, oh.app.Config.Env.String())
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// verifyCodeChallenge() checks a PKCE code verifier against the S256 code challenge
+// sent with the authorization request.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
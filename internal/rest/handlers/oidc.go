@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/AguilaMike/greenlight/internal/auth"
+	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
+)
+
+// Users have oidcStateTTL to sign in with the identity provider and come back, during
+// which the state is also kept in the oidcStateCookie cookie.
+const (
+	oidcStateTTL    = 10 * time.Minute
+	oidcStateCookie = "oidc_state"
+)
+
+// errRegistrationClosed is returned when someone without an account signs in with the
+// identity provider while open registration is disabled.
+var errRegistrationClosed = errors.New("registration closed")
+
+type OIDCHandler struct {
+	AppHandler
+}
+
+func NewOIDCHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
+	return &OIDCHandler{
+		AppHandler: AppHandler{
+			app:        app,
+			apiVersion: config.API_VERSION,
+			areaName:   "oidc",
+			mid:        mid,
+		},
+	}
+}
+
+func (oh *OIDCHandler) SetRoutes(r *httprouter.Router) {
+	// Signing in with an external identity provider is only available when one has been
+	// configured.
+	if oh.app.OIDC == nil {
+		return
+	}
+
+	r.HandlerFunc(http.MethodGet, oh.getURLPattern(oh.areaName+"/authorize"), oh.authorizeHandler)
+	r.HandlerFunc(http.MethodGet, oh.getURLPattern(oh.areaName+"/callback"), oh.callbackHandler)
+}
+
+// Start signing in with the identity provider by redirecting the user to its
+// authorization endpoint.
+func (oh *OIDCHandler) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	// The user has 10 minutes to sign in with the provider and come back.
+	state, err := oh.app.Models.OIDCStates.New(r.Context(), oidcStateTTL)
+	if err != nil {
+		oh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// Bind the state to the browser that started signing in, by also storing it in a
+	// cookie which the callback checks. Otherwise an attacker could start signing in
+	// themselves and trick the victim into following the callback link, logging the
+	// victim into the attacker's account.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state.State,
+		Path:     oh.getURLPattern(oh.areaName),
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		Secure:   oh.app.Config.Env != config.Development,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, oh.app.OIDC.AuthCodeURL(state.State, state.Nonce, state.CodeVerifier), http.StatusFound)
+}
+
+// Finish signing in with the identity provider. The provider redirects the user here
+// with an authorization code, which we exchange for an ID token, and then log in the
+// user linked to the identity in it.
+func (oh *OIDCHandler) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	// If the user cancelled, or the provider refused the request, it tells us with an
+	// error parameter instead of an authorization code.
+	if providerError := qs.Get("error"); providerError != "" {
+		v.AddError("error", providerError)
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	v.Check(qs.Get("state") != "", "state", "must be provided")
+	v.Check(qs.Get("code") != "", "code", "must be provided")
+
+	if !v.Valid() {
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The state must match the one stored in the cookie when the browser started signing
+	// in. Either way the cookie has done its job, so we delete it.
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(qs.Get("state"))) != 1 {
+		v.AddError("state", "does not match the browser that started signing in")
+		oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     oh.getURLPattern(oh.areaName),
+		MaxAge:   -1,
+		Secure:   oh.app.Config.Env != config.Development,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	state, err := oh.app.Models.OIDCStates.Consume(r.Context(), qs.Get("state"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		default:
+			oh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	identity, err := oh.app.OIDC.Exchange(ctx, qs.Get("code"), state.Nonce, state.CodeVerifier)
+	if err != nil {
+		oh.app.Logger.WarnContext(r.Context(), "oidc code exchange failed", "error", err.Error())
+		oh.app.Errors.InvalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := oh.userForIdentity(r.Context(), identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrEmailNotVerified):
+			v.AddError("email", "must be verified by the identity provider")
+			oh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, errRegistrationClosed):
+			oh.app.Errors.RegistrationClosedResponse(w, r)
+		default:
+			oh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	oh.completeLogin(w, r, user)
+}
+
+// The userForIdentity() helper returns the user linked to the identity. The first time
+// someone signs in with the provider we link the identity to the user with the same
+// email address, creating a new activated user if there isn't one (and open
+// registration is enabled). This is only safe if the provider has verified the email
+// address, so otherwise we refuse.
+func (oh *OIDCHandler) userForIdentity(ctx context.Context, identity *auth.Identity) (*data.User, error) {
+	user, err := oh.app.Models.Identities.GetUser(ctx, identity.Provider, identity.Subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, auth.ErrEmailNotVerified
+	}
+
+	user, err = oh.app.Models.Users.GetByEmail(ctx, identity.Email)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound) && !oh.app.Config.Registration.Open:
+		return nil, errRegistrationClosed
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = oh.createUserForIdentity(ctx, identity)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case !user.Activated:
+		err = oh.claimUnactivatedUser(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = oh.app.Models.Identities.Insert(ctx, user.ID, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The claimUnactivatedUser() helper activates an existing user whose email address the
+// provider has verified, which is exactly what our activation tokens are for. Nothing
+// proves that whoever registered the account owns the address though: an attacker could
+// have registered the victim's email address with a password of their own, waiting for
+// the victim to sign in with the provider. So we replace the password with a random one
+// and delete all the tokens issued for the account before handing it over.
+func (oh *OIDCHandler) claimUnactivatedUser(ctx context.Context, user *data.User) error {
+	err := setRandomPassword(user)
+	if err != nil {
+		return err
+	}
+
+	user.Activated = true
+
+	err = oh.app.Models.Users.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset, data.ScopeTwoFactor, data.ScopeMagicLink} {
+		err = oh.app.Models.Tokens.DeleteAllForUser(ctx, scope, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The createUserForIdentity() helper creates a new activated user for an identity,
+// with the same permissions as a user who registers with a password.
+func (oh *OIDCHandler) createUserForIdentity(ctx context.Context, identity *auth.Identity) (*data.User, error) {
+	name := identity.Name
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     identity.Email,
+		Activated: true,
+	}
+
+	// The user signs in with the provider, so they don't have a password.
+	err := setRandomPassword(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = oh.app.Models.Users.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = oh.app.Models.Permissions.AddForUser(ctx, user.ID, permissionReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The setRandomPassword() helper sets the password of the user to a long random one that
+// nobody knows, which they can replace with a password of their own through the password
+// reset flow.
+func setRandomPassword(user *data.User) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	return user.Password.Set(hex.EncodeToString(randomBytes))
+}
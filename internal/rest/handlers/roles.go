@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+var (
+	permissionUsersWrite = "users:write"
+)
+
+type RoleHandler struct {
+	AppHandler
+}
+
+func NewRoleHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
+	return &RoleHandler{
+		AppHandler: AppHandler{
+			app:        app,
+			apiVersion: config.API_VERSION,
+			areaName:   "roles",
+			mid:        mid,
+		},
+	}
+}
+
+func (rh *RoleHandler) SetRoutes(r *httprouter.Router) {
+	r.HandlerFunc(http.MethodGet, rh.getURLPattern(rh.areaName), rh.mid.RequirePermission(permissionUsersWrite, rh.listRolesHandler))
+	r.HandlerFunc(http.MethodPut, rh.getURLPattern(rh.areaName+"/assignments"), rh.mid.RequirePermission(permissionUsersWrite, rh.assignRolesHandler))
+}
+
+// Show all the roles along with the permission codes that each of them bundles.
+func (rh *RoleHandler) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := rh.app.Models.Roles.GetAll(r.Context())
+	if err != nil {
+		rh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"roles": roles}, nil, rh.app.Config.Env.String())
+	if err != nil {
+		rh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Replace the roles assigned to a specific user.
+func (rh *RoleHandler) assignRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int64    `json:"user_id"`
+		Roles  []string `json:"roles"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		rh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	// Fetch the existing roles so that we can check the requested codes against them,
+	// rather than silently ignoring any unknown role.
+	roles, err := rh.app.Models.Roles.GetAll(r.Context())
+	if err != nil {
+		rh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	codes := make([]string, 0, len(roles))
+	for _, role := range roles {
+		codes = append(codes, role.Code)
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID > 0, "user_id", "must be provided")
+	v.Check(input.Roles != nil, "roles", "must be provided")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+	for _, role := range input.Roles {
+		v.Check(validator.PermittedValue(role, codes...), "roles", fmt.Sprintf("role %q does not exist", role))
+	}
+
+	if !v.Valid() {
+		rh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The roles could still have changed since we fetched them, so the model checks
+	// the codes again.
+	var unknownRole *data.UnknownRoleError
+
+	err = rh.app.Models.Roles.SetForUser(r.Context(), input.UserID, input.Roles...)
+	if err != nil {
+		switch {
+		case errors.As(err, &unknownRole):
+			v.AddError("roles", fmt.Sprintf("role %q does not exist", unknownRole.Code))
+			rh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "no matching user found")
+			rh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		default:
+			rh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"user_id": input.UserID, "roles": input.Roles}, nil, rh.app.Config.Env.String())
+	if err != nil {
+		rh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
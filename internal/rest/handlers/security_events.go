@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/validator"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+// The recordSecurityEvent() helper records a security event of the given type against
+// the user, along with the IP address and user agent of the client making the request.
+// It is called once the action it records has already happened, so a failure to store
+// the event is logged rather than failing the request.
+func (ah *AppHandler) recordSecurityEvent(r *http.Request, userID int64, eventType string) {
+	event := &data.SecurityEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IP:        middlewares.ContextGetClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	err := ah.app.Models.SecurityEvents.Insert(r.Context(), event)
+	if err != nil {
+		ah.app.Logger.ErrorContext(r.Context(), "recording security event failed", "type", eventType, "user_id", userID, "error", err.Error())
+	}
+}
+
+// The recordLogin() helper records a successful login for the user. If the login comes
+// from a device (user agent) that the user has never logged in from before, we send
+// them an email about it so that they can act quickly if it wasn't them. Like
+// recordSecurityEvent(), it only logs any error, so that it never stops the user from
+// logging in.
+func (ah *AppHandler) recordLogin(r *http.Request, user *data.User) {
+	newDevice, firstLogin, err := ah.app.Models.SecurityEvents.IsNewDevice(r.Context(), user.ID, r.UserAgent())
+	if err != nil {
+		ah.app.Logger.ErrorContext(r.Context(), "checking for a new device failed", "user_id", user.ID, "error", err.Error())
+	}
+
+	ah.recordSecurityEvent(r, user.ID, data.EventLoginSucceeded)
+
+	if err == nil && newDevice && !firstLogin {
+		ip := middlewares.ContextGetClientIP(r)
+		userAgent := r.UserAgent()
+
+		ah.app.Worker.Background(r.Context(), func(ctx context.Context) {
+			data := map[string]any{
+				"ip":        ip,
+				"userAgent": userAgent,
+				"time":      time.Now().UTC().Format(time.RFC1123),
+			}
+
+			err := ah.app.Mailer.Send(ctx, user.Email, "new_device_login.tmpl", data)
+			if err != nil {
+				ah.app.Logger.ErrorContext(ctx, err.Error())
+			}
+		})
+	}
+}
+
+// Show the security events recorded against the account of the user making the
+// request, most recent first by default.
+func (uh *UserHandler) listSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = helper.QpReadInt(qs, "page", 1, v)
+	input.Filters.PageSize = helper.QpReadInt(qs, "page_size", 20, v)
+	input.Filters.Sort = helper.QpReadString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := middlewares.ContextGetUser(r)
+
+	events, metadata, err := uh.app.Models.SecurityEvents.GetAllForUser(r.Context(), user.ID, input.Filters)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"security_events": events, "metadata": metadata}, nil, uh.app.Config.Env.String())
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
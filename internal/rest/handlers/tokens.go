@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/AguilaMike/greenlight/internal/auth"
 	"github.com/AguilaMike/greenlight/internal/config"
 	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/totp"
 	"github.com/AguilaMike/greenlight/internal/validator"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
@@ -18,20 +22,27 @@ type TokenHandler struct {
 	AppHandler
 }
 
-func NewTokenHandler(app *config.Application) handler.AreaHandler {
+func NewTokenHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
 	return &TokenHandler{
 		AppHandler: AppHandler{
 			app:        app,
 			apiVersion: config.API_VERSION,
 			areaName:   "tokens",
+			mid:        mid,
 		},
 	}
 }
 
 func (u *TokenHandler) SetRoutes(r *httprouter.Router) {
-	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/authentication", u.createAuthenticationTokenHandler)
-	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/activation", u.createActivationTokenHandler)
-	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/password-reset", u.createPasswordResetTokenHandler)
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/authentication", u.mid.RequireFirstParty(u.createAuthenticationTokenHandler))
+	r.HandlerFunc(http.MethodDelete, u.getURLPattern(u.areaName)+"/authentication", u.mid.RequireFirstPartyUser(u.deleteAuthenticationTokenHandler))
+	r.HandlerFunc(http.MethodDelete, u.getURLPattern(u.areaName)+"/authentication/all", u.mid.RequireFirstPartyUser(u.deleteAllAuthenticationTokensHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/refresh", u.mid.RequireFirstParty(u.refreshAuthenticationTokenHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/2fa", u.mid.RequireFirstParty(u.createTwoFactorAuthenticationTokenHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/magic-link", u.mid.RequireFirstParty(u.createMagicLinkTokenHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/magic-link/redeem", u.mid.RequireFirstParty(u.redeemMagicLinkTokenHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/activation", u.mid.RequireFirstParty(u.createActivationTokenHandler))
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName)+"/password-reset", u.mid.RequireFirstParty(u.createPasswordResetTokenHandler))
 }
 
 func (th *TokenHandler) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -58,13 +69,32 @@ func (th *TokenHandler) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Before checking the password, make sure that the client isn't being delayed or
+	// locked out because of previous failed attempts. We do this even if no user exists
+	// with the email address, so that the response doesn't reveal whether it does.
+	retryAfter, err := th.loginRetryAfter(r, input.Email)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		th.app.Errors.TooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
-	user, err := th.app.Models.Users.GetByEmail(input.Email)
+	user, err := th.app.Models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = th.recordLoginFailure(r, input.Email, nil)
+			if err != nil {
+				th.app.Errors.ServerErrorResponse(w, r, err)
+				return
+			}
 			th.app.Errors.InvalidCredentialsResponse(w, r)
 		default:
 			th.app.Errors.ServerErrorResponse(w, r, err)
@@ -82,21 +112,594 @@ func (th *TokenHandler) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
 	// helper again and return.
 	if !match {
+		err = th.recordLoginFailure(r, input.Email, user)
+		if err != nil {
+			th.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
 		th.app.Errors.InvalidCredentialsResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := th.app.Models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// If the password was hashed with an older algorithm or weaker parameters, take the
+	// chance to upgrade it while we have the plaintext. This isn't essential for the
+	// login to succeed, so any edit conflict is simply logged and the login carries on.
+	if user.Password.NeedsRehash() {
+		err = th.rehashPassword(r.Context(), user, input.Password)
+		if err != nil {
+			th.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The password is correct, so forget about any earlier failures for the account.
+	err = th.app.Models.LoginFailures.Delete(r.Context(), data.LoginFailureKeyForEmail(user.Email))
 	if err != nil {
 		th.app.Errors.ServerErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	// Finally, log the user in.
+	th.completeLogin(w, r, user)
+}
+
+// The completeLogin() helper finishes a login once the user has proved who they are
+// with their first factor (a password or a magic link). If the user has enabled
+// two-factor authentication that isn't enough, so instead of authentication tokens we
+// issue a short-lived token which must be exchanged, together with a valid TOTP code,
+// at POST /v1/tokens/2fa. Otherwise we start a new token family and issue the first
+// pair of access and refresh tokens in it.
+func (ah *AppHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.TOTPEnabled {
+		token, err := ah.app.Models.Tokens.NewForClient(r.Context(), user.ID, 5*time.Minute, data.ScopeTwoFactor, "", middlewares.ContextGetClientIP(r), r.UserAgent())
+		if err != nil {
+			ah.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		env := helper.Envelope{
+			"two_factor_token": token,
+			"message":          "a two-factor authentication code is required to complete the login",
+		}
+
+		err = helper.WriteJSON(w, http.StatusAccepted, env, nil, ah.app.Config.Env.String())
+		if err != nil {
+			ah.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ah.recordLogin(r, user)
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := ah.issueAuthenticationTokens(r, user.ID, family)
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = helper.WriteJSON(w, http.StatusCreated, helper.Envelope{"authentication_token": token}, nil, th.app.Config.Env.String())
+	err = helper.WriteJSON(w, http.StatusCreated, env, nil, ah.app.Config.Env.String())
+	if err != nil {
+		ah.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Email the user a one-time link which can be redeemed for authentication tokens
+// without a password.
+func (th *TokenHandler) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		th.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The response is the same whether or not a user exists with the email address, so
+	// that this endpoint can't be used to find out who has an account.
+	env := helper.Envelope{"message": "if an account exists for this email address, you will be sent a login link"}
+
+	user, err := th.app.Models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = helper.WriteJSON(w, http.StatusAccepted, env, nil, th.app.Config.Env.String())
+			if err != nil {
+				th.app.Errors.ServerErrorResponse(w, r, err)
+			}
+		default:
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Create a new magic link token with a 15-minute expiry time.
+	token, err := th.app.Models.Tokens.New(r.Context(), user.ID, 15*time.Minute, data.ScopeMagicLink)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	th.app.Worker.Background(r.Context(), func(ctx context.Context) {
+		data := map[string]any{
+			"magicLinkToken": token.Plaintext,
+		}
+
+		err := th.app.Mailer.Send(ctx, user.Email, "token_magic_link.tmpl", data)
+		if err != nil {
+			th.app.Logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	err = helper.WriteJSON(w, http.StatusAccepted, env, nil, th.app.Config.Env.String())
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Redeem a magic link token for authentication tokens (or a two-factor challenge, if
+// the user has enabled two-factor authentication).
+func (th *TokenHandler) redeemMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		th.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := th.app.Models.Users.GetForToken(r.Context(), data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic link token")
+			th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		default:
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Magic links are one-time use, so delete all of them for the user straight away.
+	err = th.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopeMagicLink, user.ID)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	th.completeLogin(w, r, user)
+}
+
+// Complete a two-step login by exchanging a 2fa-pending token and either a TOTP code or
+// one of the user's recovery codes for authentication tokens.
+func (th *TokenHandler) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		th.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+
+	if !v.Valid() {
+		th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := th.app.Models.Users.GetForToken(r.Context(), data.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		default:
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Guessing a six-digit code is a lot easier than guessing a password, so failed
+	// codes count towards the same delays and lockouts as failed passwords.
+	retryAfter, err := th.loginRetryAfter(r, user.Email)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		th.app.Errors.TooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// Check the TOTP code if one was provided, otherwise fall back to the recovery
+	// code. A recovery code is deleted as soon as it has been used.
+	var valid bool
+	if input.Code != "" {
+		valid, err = th.validateTOTPCode(r.Context(), user, input.Code)
+	} else {
+		valid, err = th.app.Models.RecoveryCodes.Consume(r.Context(), user.ID, input.RecoveryCode)
+	}
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !valid {
+		err = th.recordLoginFailure(r, user.Email, user)
+		if err != nil {
+			th.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+		th.app.Errors.InvalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = th.app.Models.LoginFailures.Delete(r.Context(), data.LoginFailureKeyForEmail(user.Email))
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// The 2fa-pending token has done its job, so we delete it (and any others) to make
+	// sure it can't be exchanged a second time.
+	err = th.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	th.recordLogin(r, user)
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := th.issueAuthenticationTokens(r, user.ID, family)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusCreated, env, nil, th.app.Config.Env.String())
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// The rehashPassword() helper hashes the password again with the current settings and
+// saves it.
+func (th *TokenHandler) rehashPassword(ctx context.Context, user *data.User, plaintextPassword string) error {
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	err = th.app.Models.Users.Update(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			th.app.Logger.Warn("password rehash skipped due to an edit conflict", "user_id", user.ID)
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The loginRetryAfter() helper returns how long the client must wait before making
+// another login attempt for the email address, taking into account the failures
+// recorded against both the account and the client IP address. It is shared by every
+// handler which checks a password or a two-factor code, so that they all count towards
+// the same lockout.
+func (ah *AppHandler) loginRetryAfter(r *http.Request, email string) (time.Duration, error) {
+	cfg := ah.app.Config.Login
+	now := time.Now()
+
+	keys := []string{
+		data.LoginFailureKeyForEmail(email),
+		data.LoginFailureKeyForIP(middlewares.ContextGetClientIP(r)),
+	}
+
+	var retryAfter time.Duration
+
+	for _, key := range keys {
+		failure, err := ah.app.Models.LoginFailures.Get(r.Context(), key)
+		if err != nil {
+			return 0, err
+		}
+
+		retryAfter = max(retryAfter, failure.RetryAfter(now, cfg.BaseDelay, cfg.MaxDelay))
+	}
+
+	return retryAfter, nil
+}
+
+// The recordLoginFailure() helper records a failed login attempt against both the
+// account and the client IP address, locking either of them out once it reaches its
+// limit. If the account is locked and belongs to a real user, we let them know by email.
+func (ah *AppHandler) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	cfg := ah.app.Config.Login
+	lockedUntil := time.Now().Add(cfg.Lockout)
+
+	// Failed attempts against a real account also show up in the user's security events.
+	if user != nil {
+		ah.recordSecurityEvent(r, user.ID, data.EventLoginFailed)
+	}
+
+	ipKey := data.LoginFailureKeyForIP(middlewares.ContextGetClientIP(r))
+
+	failure, err := ah.app.Models.LoginFailures.RecordFailure(r.Context(), ipKey, cfg.Window)
+	if err != nil {
+		return err
+	}
+
+	if failure.Failures >= cfg.MaxAttemptsPerIP {
+		err = ah.app.Models.LoginFailures.Lock(r.Context(), ipKey, lockedUntil)
+		if err != nil {
+			return err
+		}
+	}
+
+	emailKey := data.LoginFailureKeyForEmail(email)
+
+	failure, err = ah.app.Models.LoginFailures.RecordFailure(r.Context(), emailKey, cfg.Window)
+	if err != nil {
+		return err
+	}
+
+	if failure.Failures < cfg.MaxAttempts {
+		return nil
+	}
+
+	err = ah.app.Models.LoginFailures.Lock(r.Context(), emailKey, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if user != nil {
+		ah.app.Worker.Background(r.Context(), func(ctx context.Context) {
+			data := map[string]any{
+				"failures":    failure.Failures,
+				"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+			}
+
+			err := ah.app.Mailer.Send(ctx, user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				ah.app.Logger.ErrorContext(ctx, err.Error())
+			}
+		})
+	}
+
+	return nil
+}
+
+// The validateTOTPCode() helper decrypts the user's TOTP secret and checks the code
+// against it. A code is only accepted once: after it has been used, it (and any code
+// from an earlier time step) is rejected, so that a code seen over the user's shoulder
+// or captured in transit can't be replayed while it is still valid.
+func (ah *AppHandler) validateTOTPCode(ctx context.Context, user *data.User, code string) (bool, error) {
+	if ah.app.Cipher == nil || user.TOTPSecret == nil {
+		return false, errors.New("two-factor authentication is not configured")
+	}
+
+	secret, err := ah.app.Cipher.Decrypt(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+
+	step, valid := totp.Validate(string(secret), code, time.Now())
+	if !valid {
+		return false, nil
+	}
+
+	return ah.app.Models.Users.UseTOTPStep(ctx, user.ID, step)
+}
+
+// The issueAuthenticationTokens() helper generates a short-lived access token and a
+// long-lived refresh token in the given token family, and returns them in an envelope
+// ready to be sent to the client. We also record the client's IP address and user agent
+// so that the user can recognise this session later.
+func (ah *AppHandler) issueAuthenticationTokens(r *http.Request, userID int64, family string) (helper.Envelope, error) {
+	ip := middlewares.ContextGetClientIP(r)
+
+	var accessToken *data.Token
+
+	// If signed tokens are enabled, embed the user's current activation state and
+	// permissions in a signed access token instead of storing it in the database.
+	if ah.app.Signer != nil {
+		user, err := ah.app.Models.Users.Get(r.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions, err := ah.app.Models.Permissions.GetAllForUser(r.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+
+		accessToken, err = ah.app.Signer.Sign(user, permissions, family, ah.app.Config.Auth.AccessTokenTTL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		accessToken, err = ah.app.Models.Tokens.NewForClient(r.Context(), userID, ah.app.Config.Auth.AccessTokenTTL, data.ScopeAuthentication, family, ip, r.UserAgent())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refreshToken, err := ah.app.Models.Tokens.NewForClient(r.Context(), userID, ah.app.Config.Auth.RefreshTokenTTL, data.ScopeRefresh, family, ip, r.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.Envelope{"authentication_token": accessToken, "refresh_token": refreshToken}, nil
+}
+
+// Exchange a refresh token for a new pair of access and refresh tokens. Refresh tokens
+// can only be used once, and presenting one a second time revokes the whole token
+// family.
+func (th *TokenHandler) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		th.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		th.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Mark the refresh token as used. If it has been used before, then either the
+	// client or an attacker is replaying it, and all the tokens in its family have now
+	// been revoked.
+	token, err := th.app.Models.Tokens.Consume(r.Context(), data.ScopeRefresh, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			th.app.Logger.WarnContext(r.Context(), "refresh token reused, token family revoked", "ip", middlewares.ContextGetClientIP(r))
+			th.app.Errors.InvalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			th.app.Errors.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The access tokens previously issued in this family are superseded by the new
+	// one, so we revoke them rather than leaving them valid until they expire.
+	err = th.app.Models.Tokens.DeleteFamily(r.Context(), data.ScopeAuthentication, token.Family)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := th.issueAuthenticationTokens(r, token.UserID, token.Family)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusCreated, env, nil, th.app.Config.Env.String())
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the authentication token that was used to make the request, along with the
+// refresh token issued with it, effectively logging the user out of the current session.
+func (th *TokenHandler) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := middlewares.ContextGetToken(r)
+
+	// Signed tokens can't be revoked before they expire, which is why they are kept
+	// short-lived. Revoking their refresh token makes sure the session ends there.
+	if th.app.Signer != nil && auth.IsSigned(token) {
+		claims, err := th.app.Signer.Verify(token)
+		if err != nil {
+			th.app.Errors.InvalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		err = th.app.Models.Tokens.DeleteFamily(r.Context(), data.ScopeRefresh, claims.Family)
+		if err != nil {
+			th.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		th.recordSecurityEvent(r, middlewares.ContextGetUser(r).ID, data.EventTokenRevoked)
+
+		err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "authentication token successfully revoked"}, nil, th.app.Config.Env.String())
+		if err != nil {
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err := th.app.Models.Tokens.DeleteWithFamily(r.Context(), data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			th.app.Errors.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			th.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	th.recordSecurityEvent(r, middlewares.ContextGetUser(r).ID, data.EventTokenRevoked)
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "authentication token successfully revoked"}, nil, th.app.Config.Env.String())
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Revoke every authentication token belonging to the user, logging them out of all
+// their sessions (including the current one).
+func (th *TokenHandler) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.ContextGetUser(r)
+
+	err := th.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = th.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopeRefresh, user.ID)
+	if err != nil {
+		th.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	th.recordSecurityEvent(r, user.ID, data.EventAllTokensRevoked)
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"message": "all authentication tokens successfully revoked"}, nil, th.app.Config.Env.String())
 	if err != nil {
 		th.app.Errors.ServerErrorResponse(w, r, err)
 	}
@@ -124,7 +727,7 @@ func (th *TokenHandler) createPasswordResetTokenHandler(w http.ResponseWriter, r
 
 	// Try to retrieve the corresponding user record for the email address. If it can't
 	// be found, return an error message to the client.
-	user, err := th.app.Models.Users.GetByEmail(input.Email)
+	user, err := th.app.Models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -144,14 +747,16 @@ func (th *TokenHandler) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 
 	// Otherwise, create a new password reset token with a 45-minute expiry time.
-	token, err := th.app.Models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	token, err := th.app.Models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
 	if err != nil {
 		th.app.Errors.ServerErrorResponse(w, r, err)
 		return
 	}
 
+	th.recordSecurityEvent(r, user.ID, data.EventPasswordResetRequested)
+
 	// Email the user with their password reset token.
-	th.app.Worker.Background(func() {
+	th.app.Worker.Background(r.Context(), func(ctx context.Context) {
 		data := map[string]any{
 			"passwordResetToken": token.Plaintext,
 		}
@@ -159,9 +764,9 @@ func (th *TokenHandler) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		// Since email addresses MAY be case sensitive, notice that we are sending this
 		// email using the address stored in our database for the user --- not to the
 		// input.Email address provided by the client in this request.
-		err = th.app.Mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		err := th.app.Mailer.Send(ctx, user.Email, "token_password_reset.tmpl", data)
 		if err != nil {
-			th.app.Logger.Error(err.Error())
+			th.app.Logger.ErrorContext(ctx, err.Error())
 		}
 	})
 
@@ -195,7 +800,7 @@ func (th *TokenHandler) createActivationTokenHandler(w http.ResponseWriter, r *h
 
 	// Try to retrieve the corresponding user record for the email address. If it can't
 	// be found, return an error message to the client.
-	user, err := th.app.Models.Users.GetByEmail(input.Email)
+	user, err := th.app.Models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -215,14 +820,14 @@ func (th *TokenHandler) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Otherwise, create a new activation token.
-	token, err := th.app.Models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := th.app.Models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		th.app.Errors.ServerErrorResponse(w, r, err)
 		return
 	}
 
 	// Email the user with their additional activation token.
-	th.app.Worker.Background(func() {
+	th.app.Worker.Background(r.Context(), func(ctx context.Context) {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
 		}
@@ -230,9 +835,9 @@ func (th *TokenHandler) createActivationTokenHandler(w http.ResponseWriter, r *h
 		// Since email addresses MAY be case sensitive, notice that we are sending this
 		// email using the address stored in our database for the user --- not to the
 		// input.Email address provided by the client in this request.
-		err = th.app.Mailer.Send(user.Email, "token_activation.tmpl", data)
+		err := th.app.Mailer.Send(ctx, user.Email, "token_activation.tmpl", data)
 		if err != nil {
-			th.app.Logger.Error(err.Error())
+			th.app.Logger.ErrorContext(ctx, err.Error())
 		}
 	})
 
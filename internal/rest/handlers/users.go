@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/AguilaMike/greenlight/internal/auth"
 	"github.com/AguilaMike/greenlight/internal/config"
 	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
+	"github.com/AguilaMike/greenlight/internal/totp"
 	"github.com/AguilaMike/greenlight/internal/validator"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/handler"
 	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
@@ -18,23 +22,41 @@ type UserHandler struct {
 	AppHandler
 }
 
-func NewUserHandler(app *config.Application) handler.AreaHandler {
+func NewUserHandler(app *config.Application, mid *middlewares.AppMiddleware) handler.AreaHandler {
 	return &UserHandler{
 		AppHandler: AppHandler{
 			app:        app,
 			apiVersion: config.API_VERSION,
 			areaName:   "users",
+			mid:        mid,
 		},
 	}
 }
 
 func (u *UserHandler) SetRoutes(r *httprouter.Router) {
-	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName), u.registerUserHandler)
+	r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName), u.mid.Idempotency(u.registerUserHandler))
 	r.HandlerFunc(http.MethodPut, u.getURLPattern(u.areaName+"/activated"), u.activateUserHandler)
 	r.HandlerFunc(http.MethodPut, u.getURLPattern(u.areaName+"/password"), u.updateUserPasswordHandler)
+	r.HandlerFunc(http.MethodGet, u.getURLPattern(u.areaName+"/me/sessions"), u.mid.RequireFirstPartyUser(u.listSessionsHandler))
+	r.HandlerFunc(http.MethodGet, u.getURLPattern(u.areaName+"/me/security-events"), u.mid.RequireFirstPartyUser(u.listSecurityEventsHandler))
+
+	// Two-factor authentication can only be enrolled in when an encryption key for the
+	// TOTP secrets has been configured.
+	if u.app.Cipher != nil {
+		r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName+"/me/2fa"), u.mid.RequireActivatedUser(u.mid.RequireFirstParty(u.enrollTwoFactorHandler)))
+		r.HandlerFunc(http.MethodPost, u.getURLPattern(u.areaName+"/me/2fa/confirm"), u.mid.RequireActivatedUser(u.mid.RequireFirstParty(u.confirmTwoFactorHandler)))
+		r.HandlerFunc(http.MethodDelete, u.getURLPattern(u.areaName+"/me/2fa"), u.mid.RequireActivatedUser(u.mid.RequireFirstParty(u.disableTwoFactorHandler)))
+	}
 }
 
 func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	// If open registration has been disabled, new users can only sign up with an
+	// invitation (see the InvitationHandler).
+	if !uh.app.Config.Registration.Open {
+		uh.app.Errors.RegistrationClosedResponse(w, r)
+		return
+	}
+
 	// Create an anonymous struct to hold the expected data from the request body.
 	var input struct {
 		Name     string `json:"name"`
@@ -69,15 +91,18 @@ func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Reques
 
 	v := validator.New()
 
-	// Validate the user struct and return the error messages to the client if any of
-	// the checks fail.
-	if data.ValidateUser(v, user); !v.Valid() {
+	// Validate the user struct and the new password against the password policy, and
+	// return the error messages to the client if any of the checks fail.
+	data.ValidateUser(v, user)
+	data.ValidatePasswordPolicy(v, uh.app.PasswordPolicy, input.Password, user)
+
+	if !v.Valid() {
 		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Insert the user data into the database.
-	err = uh.app.Models.Users.Insert(user)
+	err = uh.app.Models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -93,7 +118,7 @@ func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Add the "movies:read" permission for the new user.
-	err = uh.app.Models.Permissions.AddForUser(user.ID, permissionReadOnly)
+	err = uh.app.Models.Permissions.AddForUser(r.Context(), user.ID, permissionReadOnly)
 	if err != nil {
 		uh.app.Errors.ServerErrorResponse(w, r, err)
 		return
@@ -101,7 +126,7 @@ func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Reques
 
 	// After the user record has been created in the database, generate a new activation
 	// token for the user.
-	token, err := uh.app.Models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := uh.app.Models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		uh.app.Errors.ServerErrorResponse(w, r, err)
 		return
@@ -109,7 +134,7 @@ func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Reques
 
 	// Launch a goroutine which runs an anonymous function that sends the welcome email.
 	// Use the background helper to execute an anonymous function that sends the welcome email.
-	uh.app.Worker.Background(func() {
+	uh.app.Worker.Background(r.Context(), func(ctx context.Context) {
 		// As there are now multiple pieces of data that we want to pass to our email
 		// templates, we create a map to act as a 'holding structure' for the data. This
 		// contains the plaintext version of the activation token for the user, along
@@ -120,12 +145,12 @@ func (uh *UserHandler) registerUserHandler(w http.ResponseWriter, r *http.Reques
 		}
 
 		// Send the welcome email, passing in the map above as dynamic data.
-		err = uh.app.Mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err := uh.app.Mailer.Send(ctx, user.Email, "user_welcome.tmpl", data)
 		if err != nil {
 			// Importantly, if there is an error sending the email then we use the
 			// app.logger.Error() helper to manage it, instead of the
 			// app.serverErrorResponse() helper like before.
-			uh.app.Logger.Error(err.Error())
+			uh.app.Logger.ErrorContext(ctx, err.Error())
 		}
 	})
 
@@ -162,7 +187,7 @@ func (uh *UserHandler) activateUserHandler(w http.ResponseWriter, r *http.Reques
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method (which we will create in a minute). If no matching record
 	// is found, then we let the client know that the token they provided is not valid.
-	user, err := uh.app.Models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := uh.app.Models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -179,7 +204,7 @@ func (uh *UserHandler) activateUserHandler(w http.ResponseWriter, r *http.Reques
 
 	// Save the updated user record in our database, checking for any edit conflicts in
 	// the same way that we did for our movie records.
-	err = uh.app.Models.Users.Update(user)
+	err = uh.app.Models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -192,12 +217,14 @@ func (uh *UserHandler) activateUserHandler(w http.ResponseWriter, r *http.Reques
 
 	// If everything went successfully, then we delete all activation tokens for the
 	// user.
-	err = uh.app.Models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = uh.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
 	if err != nil {
 		uh.app.Errors.ServerErrorResponse(w, r, err)
 		return
 	}
 
+	uh.recordSecurityEvent(r, user.ID, data.EventAccountActivated)
+
 	// Send the updated user details to the client in a JSON response.
 	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"user": user}, nil, uh.app.Config.Env.String())
 	if err != nil {
@@ -231,7 +258,7 @@ func (uh *UserHandler) updateUserPasswordHandler(w http.ResponseWriter, r *http.
 
 	// Retrieve the details of the user associated with the password reset token,
 	// returning an error message if no matching record was found.
-	user, err := uh.app.Models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	user, err := uh.app.Models.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -243,6 +270,13 @@ func (uh *UserHandler) updateUserPasswordHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// Now that we know who the user is, check the new password against the password
+	// policy.
+	if data.ValidatePasswordPolicy(v, uh.app.PasswordPolicy, input.Password, user); !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Set the new password for the user.
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -252,7 +286,7 @@ func (uh *UserHandler) updateUserPasswordHandler(w http.ResponseWriter, r *http.
 
 	// Save the updated user record in our database, checking for any edit conflicts as
 	// normal.
-	err = uh.app.Models.Users.Update(user)
+	err = uh.app.Models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -264,12 +298,25 @@ func (uh *UserHandler) updateUserPasswordHandler(w http.ResponseWriter, r *http.
 	}
 
 	// If everything was successful, then delete all password reset tokens for the user.
-	err = uh.app.Models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	err = uh.app.Models.Tokens.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
 	if err != nil {
 		uh.app.Errors.ServerErrorResponse(w, r, err)
 		return
 	}
 
+	// Log the user out of all their sessions too, so that whoever might have taken over
+	// the account loses access along with the old password.
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err = uh.app.Models.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+		if err != nil {
+			uh.app.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	uh.recordSecurityEvent(r, user.ID, data.EventPasswordChanged)
+	uh.recordSecurityEvent(r, user.ID, data.EventAllTokensRevoked)
+
 	// Send the user a confirmation message.
 	env := helper.Envelope{"message": "your password was successfully reset"}
 
@@ -278,3 +325,328 @@ func (uh *UserHandler) updateUserPasswordHandler(w http.ResponseWriter, r *http.
 		uh.app.Errors.ServerErrorResponse(w, r, err)
 	}
 }
+
+// Show the active authentication tokens of the user making the request.
+func (uh *UserHandler) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := middlewares.ContextGetUser(r)
+
+	// When signed tokens are enabled the access tokens aren't stored anywhere, so we list
+	// the refresh tokens instead, as there is exactly one for each session. The current
+	// session is then the one in the same token family as the signed access token.
+	token := middlewares.ContextGetToken(r)
+	scope := data.ScopeAuthentication
+	family := ""
+
+	if uh.app.Signer != nil {
+		scope = data.ScopeRefresh
+
+		if auth.IsSigned(token) {
+			claims, err := uh.app.Signer.Verify(token)
+			if err != nil {
+				uh.app.Errors.InvalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			family = claims.Family
+		}
+	}
+
+	sessions, err := uh.app.Models.Tokens.GetAllSessionsForUser(r.Context(), scope, user.ID, token, family)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, helper.Envelope{"sessions": sessions}, nil, uh.app.Config.Env.String())
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Start enrolling the user in two-factor authentication by generating a new TOTP secret.
+// Two-factor authentication isn't enabled until the user confirms that their
+// authenticator app is set up by sending a valid code to confirmTwoFactorHandler. The
+// user must enter their password again, so that someone who gets hold of an access
+// token can't tie the account to their own authenticator app.
+func (uh *UserHandler) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		uh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch a fresh copy of the user, as we are going to update the record.
+	user, err := uh.app.Models.Users.Get(r.Context(), middlewares.ContextGetUser(r).ID)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		v.AddError("two_factor", "two-factor authentication is already enabled")
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !uh.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// Encrypt the secret before it is stored in the users table.
+	user.TOTPSecret, err = uh.app.Cipher.Encrypt([]byte(secret))
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	err = uh.app.Models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			uh.app.Errors.EditConflictResponse(w, r)
+		default:
+			uh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := helper.Envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI("Greenlight", user.Email, secret),
+	}
+
+	err = helper.WriteJSON(w, http.StatusCreated, env, nil, uh.app.Config.Env.String())
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Confirm the two-factor enrollment with a valid TOTP code, enabling two-factor
+// authentication for the user and generating their recovery codes.
+func (uh *UserHandler) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		uh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := uh.app.Models.Users.Get(r.Context(), middlewares.ContextGetUser(r).ID)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	switch {
+	case user.TOTPEnabled:
+		v.AddError("two_factor", "two-factor authentication is already enabled")
+	case user.TOTPSecret == nil:
+		v.AddError("two_factor", "two-factor enrollment must be started first")
+	}
+
+	if !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	valid, err := uh.validateTOTPCode(r.Context(), user, input.Code)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !valid {
+		v.AddError("code", "invalid two-factor authentication code")
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.TOTPEnabled = true
+
+	err = uh.app.Models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			uh.app.Errors.EditConflictResponse(w, r)
+		default:
+			uh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	codes, err := uh.app.Models.RecoveryCodes.New(r.Context(), user.ID)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	env := helper.Envelope{
+		"message":        "two-factor authentication successfully enabled",
+		"recovery_codes": codes,
+	}
+
+	err = helper.WriteJSON(w, http.StatusOK, env, nil, uh.app.Config.Env.String())
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// Disable two-factor authentication for the user, deleting their TOTP secret and
+// recovery codes. Like logging in, this needs the user's password along with either a
+// TOTP code or one of their recovery codes, so that an access token on its own isn't
+// enough to weaken the account's protection. Wrong passwords and codes count towards the
+// login lockout.
+func (uh *UserHandler) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := helper.ReadJSON(w, r, &input)
+	if err != nil {
+		uh.app.Errors.BadRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+
+	if !v.Valid() {
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := uh.app.Models.Users.Get(r.Context(), middlewares.ContextGetUser(r).ID)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		v.AddError("two_factor", "two-factor authentication is not enabled")
+		uh.app.Errors.FailedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !uh.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	var valid bool
+	if input.Code != "" {
+		valid, err = uh.validateTOTPCode(r.Context(), user, input.Code)
+	} else {
+		valid, err = uh.app.Models.RecoveryCodes.Consume(r.Context(), user.ID, input.RecoveryCode)
+	}
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	if !valid {
+		uh.rejectCredentials(w, r, user)
+		return
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = nil
+
+	err = uh.app.Models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			uh.app.Errors.EditConflictResponse(w, r)
+		default:
+			uh.app.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = uh.app.Models.RecoveryCodes.DeleteAllForUser(r.Context(), user.ID)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	uh.recordSecurityEvent(r, user.ID, data.EventTwoFactorDisabled)
+
+	env := helper.Envelope{"message": "two-factor authentication successfully disabled"}
+
+	err = helper.WriteJSON(w, http.StatusOK, env, nil, uh.app.Config.Env.String())
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+	}
+}
+
+// The checkPassword() helper checks the password the user entered to confirm a
+// sensitive change to their account. Wrong passwords count towards the same delays and
+// lockouts as failed logins, so that someone holding a stolen access token can't use
+// it to guess the password. If the client must wait, or the password doesn't match, it
+// sends the same response as the login endpoint and returns false.
+func (uh *UserHandler) checkPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	retryAfter, err := uh.loginRetryAfter(r, user.Email)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		uh.app.Errors.TooManyLoginAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		uh.rejectCredentials(w, r, user)
+		return false
+	}
+
+	return true
+}
+
+// The rejectCredentials() helper records a failed password or two-factor code against
+// the user's account and the client IP address, then sends an invalid credentials
+// response.
+func (uh *UserHandler) rejectCredentials(w http.ResponseWriter, r *http.Request, user *data.User) {
+	err := uh.recordLoginFailure(r, user.Email, user)
+	if err != nil {
+		uh.app.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	uh.app.Errors.InvalidCredentialsResponse(w, r)
+}
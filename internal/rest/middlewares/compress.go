@@ -0,0 +1,277 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The encodings we can compress responses with, in order of preference when the client
+// accepts several of them equally.
+var compressionEncodings = []string{"br", "zstd", "gzip"}
+
+// encoder is the interface shared by the gzip, brotli and zstd writers. Reset() lets us
+// reuse a writer for a new response, as they are fairly expensive to create.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Keep a pool of writers for each encoding. A pool returns nil if the writer can't be
+// created, in which case the response is sent uncompressed.
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(io.Discard, 4)
+	}},
+	"zstd": {New: func() any {
+		enc, err := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		return enc
+	}},
+	"gzip": {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+}
+
+// The Compress() middleware compresses response bodies with the best encoding that the
+// client accepts in its Accept-Encoding header. Small responses aren't worth
+// compressing, so the response is buffered until it reaches the minimum size; if it
+// never does, it is sent as it is. Responses which have already been encoded, or whose
+// content type doesn't compress well, are also left alone.
+func (am *AppMiddleware) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !am.cfg.Config.Compression.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The response depends on the Accept-Encoding header, so caches must take it
+		// into account. We use Add() so that we keep the Vary values set by the other
+		// middleware.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{
+			wrapped:    w,
+			encoding:   encoding,
+			minSize:    am.cfg.Config.Compression.MinSize,
+			statusCode: http.StatusOK,
+		}
+
+		// The response has been sent by the time the encoder is closed, so all we can do
+		// with an error is log it.
+		defer func() {
+			err := cw.close()
+			if err != nil {
+				am.cfg.Logger.ErrorContext(r.Context(), "compressing response failed", "encoding", encoding, "error", err.Error())
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// The negotiateEncoding() helper picks the encoding to use for the Accept-Encoding
+// header, returning the empty string if the response shouldn't be compressed.
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	wildcard := -1.0
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.TrimSpace(key) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					weight = q
+				}
+			}
+		}
+
+		if name == "*" {
+			wildcard = weight
+			continue
+		}
+
+		weights[name] = weight
+	}
+
+	best, bestWeight := "", 0.0
+
+	for _, encoding := range compressionEncodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight = max(wildcard, 0)
+		}
+
+		if weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+
+	return best
+}
+
+// The compressibleType() helper reports whether a response with the content type is
+// worth compressing.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/xml",
+		mediaType == "application/javascript", mediaType == "image/svg+xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	default:
+		return false
+	}
+}
+
+// compressResponseWriter buffers the start of the response until it knows whether to
+// compress it, then writes it either through the encoder or straight through to the
+// wrapped writer. The status code is held back until then too, since the headers can't
+// be changed once it has been written. Because the wrapped writer only sees the final
+// status code and bytes, the metricsResponseWriter further up the chain captures them
+// as usual.
+type compressResponseWriter struct {
+	wrapped    http.ResponseWriter
+	encoding   string
+	minSize    int
+	statusCode int
+	buf        []byte
+	decided    bool
+	encoder    encoder
+}
+
+func (cw *compressResponseWriter) Header() http.Header {
+	return cw.wrapped.Header()
+}
+
+func (cw *compressResponseWriter) WriteHeader(statusCode int) {
+	if cw.decided {
+		cw.wrapped.WriteHeader(statusCode)
+		return
+	}
+
+	cw.statusCode = statusCode
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+
+		err := cw.decide(true)
+		return len(b), err
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+
+	return cw.wrapped.Write(b)
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.wrapped
+}
+
+// The decide() method writes the status code and the buffered start of the response,
+// compressing it if large is true and the response is suitable for it.
+func (cw *compressResponseWriter) decide(large bool) error {
+	cw.decided = true
+
+	h := cw.wrapped.Header()
+
+	compress := large &&
+		cw.statusCode != http.StatusNoContent &&
+		cw.statusCode != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		compressibleType(h.Get("Content-Type"))
+
+	if compress {
+		// If no encoder could be created, fall back to sending the response as it is.
+		enc, ok := encoderPools[cw.encoding].Get().(encoder)
+		if ok {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+
+			cw.encoder = enc
+			cw.encoder.Reset(cw.wrapped)
+		}
+	}
+
+	cw.wrapped.WriteHeader(cw.statusCode)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.wrapped.Write(buf)
+	}
+
+	return err
+}
+
+// The close() method finishes the response, sending it uncompressed if it never
+// reached the minimum size, and flushing the encoder and returning it to the pool
+// otherwise. An encoder which fails to close is dropped rather than reused, in case it
+// has been left in a bad state.
+func (cw *compressResponseWriter) close() error {
+	if !cw.decided {
+		return cw.decide(false)
+	}
+
+	if cw.encoder == nil {
+		return nil
+	}
+
+	enc := cw.encoder
+	cw.encoder = nil
+
+	err := enc.Close()
+	if err != nil {
+		return err
+	}
+
+	enc.Reset(io.Discard)
+	encoderPools[cw.encoding].Put(enc)
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -15,19 +16,44 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// Likewise, use the tokenContextKey constant as the key for the plaintext
+// authentication token that was presented with the request.
+const tokenContextKey = contextKey("token")
+
+// And use the permissionsContextKey constant as the key for the permissions of the
+// user, when they are already known from the authentication token itself.
+const permissionsContextKey = contextKey("permissions")
+
+// The apiKeyContextKey constant is the key for the API key used to make the request.
+const apiKeyContextKey = contextKey("apiKey")
+
+// The clientIPContextKey constant is the key for the resolved IP address of the client.
+const clientIPContextKey = contextKey("clientIP")
+
+// The oauthTokenContextKey constant is the key for the OAuth access token used to make
+// the request.
+const oauthTokenContextKey = contextKey("oauthToken")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
 func contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// Also record the user ID in the request info, so that it is included in the log
+	// entries for the request.
+	if info := helper.ContextGetRequestInfo(r.Context()); info != nil && !user.IsAnonymous() {
+		info.UserID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
 
-// The contextGetUser() retrieves the User struct from the request context. The only
+// The ContextGetUser() retrieves the User struct from the request context. The only
 // time that we'll use this helper is when we logically expect there to be User struct
 // value in the context, and if it doesn't exist it will firmly be an 'unexpected' error.
-// As we discussed earlier in the book, it's OK to panic in those circumstances.
-func contextGetUser(r *http.Request) *data.User {
+// As we discussed earlier in the book, it's OK to panic in those circumstances. It is
+// exported so that handlers can find out who is making the request.
+func ContextGetUser(r *http.Request) *data.User {
 	user, ok := r.Context().Value(userContextKey).(*data.User)
 	if !ok {
 		panic("missing user value in request context")
@@ -35,3 +61,99 @@ func contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The ContextGetToken() retrieves the plaintext authentication token from the request
+// context, returning the empty string for anonymous requests.
+func ContextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		return ""
+	}
+
+	return token
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the
+// provided permissions added to the context.
+func contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() retrieves the permissions from the request context. The
+// second return value is false if they haven't been set, in which case they need to be
+// looked up in the database.
+func contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the provided
+// APIKey struct added to the context.
+func contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The ContextGetAPIKey() retrieves the APIKey struct from the request context, returning
+// nil if the request wasn't authenticated with an API key.
+func ContextGetAPIKey(r *http.Request) *data.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	if !ok {
+		return nil
+	}
+
+	return key
+}
+
+// The contextSetOAuthToken() method returns a new copy of the request with the provided
+// OAuthToken struct added to the context.
+func contextSetOAuthToken(r *http.Request, token *data.OAuthToken) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The ContextGetOAuthToken() retrieves the OAuthToken struct from the request context,
+// returning nil if the request wasn't authenticated with an OAuth access token.
+func ContextGetOAuthToken(r *http.Request) *data.OAuthToken {
+	token, ok := r.Context().Value(oauthTokenContextKey).(*data.OAuthToken)
+	if !ok {
+		return nil
+	}
+
+	return token
+}
+
+// The ContextIsDelegated() helper reports whether the request was made with a credential
+// which only carries part of its owner's authority (an API key or an OAuth access
+// token). Such credentials must not be able to manage the account or mint new
+// credentials.
+func ContextIsDelegated(r *http.Request) bool {
+	return ContextGetAPIKey(r) != nil || ContextGetOAuthToken(r) != nil
+}
+
+// The contextSetClientIP() method returns a new copy of the request with the client IP
+// address added to the context.
+func contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// The ContextGetClientIP() method retrieves the client IP address resolved by the
+// ClientIP() middleware from the request context. If the middleware didn't run, it
+// falls back to the remote address of the connection.
+func ContextGetClientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
+	if !ok {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
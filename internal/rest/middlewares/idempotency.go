@@ -0,0 +1,191 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/AguilaMike/greenlight/internal/data"
+)
+
+// The largest request body we read to work out the request hash. This matches the limit
+// applied by ReadJSON(), so larger requests are rejected by the handler anyway.
+const idempotencyMaxBodySize = 1_048_576
+
+// The Idempotency() middleware lets clients safely retry the POST requests which create
+// resources by sending an Idempotency-Key header. The first response to a request made
+// with a key is stored against the client and the key, and is replayed (with an
+// Idempotent-Replayed header) whenever the client retries the same request within the
+// configured window. Reusing the key for a different request is rejected, as is
+// retrying while the first request is still being processed.
+//
+// The responses are stored as they are, so it must only wrap the handlers of routes
+// whose responses don't carry credentials (tokens, API keys, secrets or recovery codes),
+// which we only ever store hashed. Those routes also have their own protections against
+// replays, which replaying a stored response would get around.
+func (am *AppMiddleware) Idempotency(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			am.cfg.Errors.BadRequestResponse(w, r, errors.New("the Idempotency-Key header must not be more than 255 characters long"))
+			return
+		}
+
+		// Read the body so that we can hash it, then put it back for the handler.
+		body, err := io.ReadAll(io.LimitReader(r.Body, idempotencyMaxBodySize+1))
+		if err != nil {
+			am.cfg.Errors.BadRequestResponse(w, r, err)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		owner := am.idempotencyOwner(r)
+		hash := data.IdempotencyRequestHash(r.Method, r.URL.Path, body)
+
+		cfg := am.cfg.Config.Idempotency
+
+		idempotencyKey, started, err := am.cfg.Models.IdempotencyKeys.Start(r.Context(), owner, key, hash, cfg.TTL, cfg.LockTimeout)
+		if err != nil {
+			am.cfg.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+
+		if !started {
+			switch {
+			case !bytes.Equal(idempotencyKey.RequestHash, hash):
+				am.cfg.Errors.IdempotencyKeyReusedResponse(w, r)
+			case idempotencyKey.InProgress():
+				am.cfg.Errors.IdempotencyKeyInUseResponse(w, r)
+			default:
+				for name, values := range idempotencyKey.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(idempotencyKey.StatusCode)
+				w.Write(idempotencyKey.Body)
+			}
+			return
+		}
+
+		// From here on we must either store the response or release the key, even if
+		// the client goes away, so we use a context which won't be cancelled with the
+		// request.
+		ctx := context.WithoutCancel(r.Context())
+
+		rec := &idempotencyResponseWriter{
+			wrapped:    w,
+			before:     w.Header().Clone(),
+			statusCode: http.StatusOK,
+		}
+
+		// If the handler panics, release the key so that the client can retry, then let
+		// RecoverPanic() deal with the panic.
+		defer func() {
+			if err := recover(); err != nil {
+				am.releaseIdempotencyKey(ctx, idempotencyKey)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		// Server errors are usually temporary, so rather than replaying them we release
+		// the key and let the client try again.
+		if rec.statusCode >= http.StatusInternalServerError {
+			am.releaseIdempotencyKey(ctx, idempotencyKey)
+			return
+		}
+
+		err = am.cfg.Models.IdempotencyKeys.Complete(ctx, idempotencyKey, rec.statusCode, rec.handlerHeader(), rec.body.Bytes())
+		if err != nil {
+			am.cfg.Logger.ErrorContext(ctx, "storing idempotent response failed", "error", err.Error())
+			am.releaseIdempotencyKey(ctx, idempotencyKey)
+		}
+	})
+}
+
+// The idempotencyOwner() helper returns who an idempotency key belongs to: the
+// authenticated user or, for anonymous requests, the client IP address.
+func (am *AppMiddleware) idempotencyOwner(r *http.Request) string {
+	if user := ContextGetUser(r); !user.IsAnonymous() {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+
+	return "ip:" + ContextGetClientIP(r)
+}
+
+// The releaseIdempotencyKey() helper deletes a key, logging any error.
+func (am *AppMiddleware) releaseIdempotencyKey(ctx context.Context, idempotencyKey *data.IdempotencyKey) {
+	err := am.cfg.Models.IdempotencyKeys.Delete(ctx, idempotencyKey)
+	if err != nil {
+		am.cfg.Logger.ErrorContext(ctx, "releasing idempotency key failed", "error", err.Error())
+	}
+}
+
+// idempotencyResponseWriter passes the response through to the client while keeping a
+// copy of it to store. It remembers the headers set before the handler ran, so that
+// only the ones set by the handler itself are stored; the rest (such as the rate limit
+// and request ID headers) are set afresh on every request.
+type idempotencyResponseWriter struct {
+	wrapped       http.ResponseWriter
+	before        http.Header
+	statusCode    int
+	headerWritten bool
+	body          bytes.Buffer
+}
+
+func (iw *idempotencyResponseWriter) Header() http.Header {
+	return iw.wrapped.Header()
+}
+
+func (iw *idempotencyResponseWriter) WriteHeader(statusCode int) {
+	iw.wrapped.WriteHeader(statusCode)
+
+	if !iw.headerWritten {
+		iw.statusCode = statusCode
+		iw.headerWritten = true
+	}
+}
+
+func (iw *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	iw.headerWritten = true
+	iw.body.Write(b)
+
+	return iw.wrapped.Write(b)
+}
+
+func (iw *idempotencyResponseWriter) Unwrap() http.ResponseWriter {
+	return iw.wrapped
+}
+
+// The handlerHeader() method returns the headers which the handler added or changed.
+func (iw *idempotencyResponseWriter) handlerHeader() http.Header {
+	header := make(http.Header)
+
+	for name, values := range iw.wrapped.Header() {
+		if !slices.Equal(iw.before[name], values) {
+			header[name] = values
+		}
+	}
+
+	// The body is stored uncompressed, and the compression middleware may encode it
+	// differently when it is replayed, so leave the encoding and length to be worked out
+	// again.
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	header.Del("Idempotent-Replayed")
+
+	return header
+}
@@ -1,21 +1,29 @@
 package middlewares
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/AguilaMike/greenlight/internal/auth"
 	"github.com/AguilaMike/greenlight/internal/config"
 	"github.com/AguilaMike/greenlight/internal/data"
+	"github.com/AguilaMike/greenlight/internal/metrics"
+	"github.com/AguilaMike/greenlight/internal/ratelimit"
 	"github.com/AguilaMike/greenlight/internal/validator"
-	"github.com/tomasen/realip"
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
 )
 
 type AppMiddleware struct {
@@ -26,6 +34,86 @@ func NewAppMiddleware(cfg *config.Application) *AppMiddleware {
 	return &AppMiddleware{cfg: cfg}
 }
 
+// The ClientIP() middleware resolves the IP address of the client, only trusting the
+// forwarded headers set by the configured proxies, and adds it to the request context.
+// It should run before every other middleware, so that they can all rely on it.
+func (am *AppMiddleware) ClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = contextSetClientIP(r, am.cfg.IPResolver.ClientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The RequestID() middleware gives every request an ID, which is sent back to the
+// client in the X-Request-ID header and included in every log entry about the request.
+// If the client (or a proxy in front of us) already sent a well-formed X-Request-ID
+// header, we keep using that ID so that the request can be followed across services.
+func (am *AppMiddleware) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		// Record the request ID on the request span too, so that log entries and traces
+		// can be matched up.
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+
+		r = r.WithContext(helper.ContextSetRequestInfo(r.Context(), &helper.RequestInfo{ID: id}))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The validRequestID() helper reports whether a request ID sent by the client is safe to
+// use, only allowing short IDs made of letters, digits and a few separators.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The newRequestID() helper generates a random 128-bit request ID, hex encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The AccessLog() middleware writes one structured log entry for every request once
+// it has been handled, with the response status and size, how long it took, and who
+// made it. The request ID and user ID are added by the log handler.
+func (am *AppMiddleware) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mw := newMetricsResponseWriter(w)
+		next.ServeHTTP(mw, r)
+
+		am.cfg.Logger.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"status", mw.statusCode,
+			"bytes", mw.bytes,
+			"duration", time.Since(start),
+			"ip", ContextGetClientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
 func (am *AppMiddleware) RecoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event of a panic
@@ -52,86 +140,111 @@ func (am *AppMiddleware) RecoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (am *AppMiddleware) RateLimit(next http.Handler) http.Handler {
-	// Define a client struct to hold the rate limiter and last seen time for each
-	// client.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// The RateLimitIP() middleware applies an overall limit to the rate of requests each IP
+// address can make. It must run before Authenticate(), so that requests with invalid
+// credentials are limited too: otherwise they would be rejected before reaching
+// RateLimit(), letting clients guess credentials (and cost us a database lookup each
+// time) as fast as they like.
+func (am *AppMiddleware) RateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := am.cfg.Config.Limiter
 
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+		if cfg.Enabled {
+			limit := ratelimit.Limit{Rate: cfg.IPRps, Burst: cfg.IPBurst}
 
-	// Launch a background goroutine which removes old entries from the clients map once
-	// every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through all clients. If they haven't been seen within the last three
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
+			if !am.rateLimit(w, r, "ip", "ip:"+ContextGetClientIP(r), limit) {
+				return
 			}
-
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
 		}
-	}()
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The RateLimit() middleware limits the rate of requests each client can make to each
+// route group. It must run after Authenticate(), so that authenticated clients can be
+// identified by their user or API key rather than their IP address.
+func (am *AppMiddleware) RateLimit(next http.Handler) http.Handler {
 	// Return an anonymous function that acts as a middleware. This function calls the
 	// next handler in the chain if the request is allowed. If the request is not
 	// allowed, it sends a 429 Too Many Requests response.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled.
 		if am.cfg.Config.Limiter.Enabled {
+			group, limit := am.rateLimitGroup(r)
 
-			// Use the realip.FromRequest() function to get the client's real IP address.
-			ip := realip.FromRequest(r)
+			// Each route group has its own bucket.
+			if !am.rateLimit(w, r, group, group+":"+am.rateLimitKey(r), limit) {
+				return
+			}
+		}
 
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
+		next.ServeHTTP(w, r)
+	})
+}
 
-			// Check to see if the IP address already exists in the map. If it doesn't, then
-			// initialize a new rate limiter and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// Create and add a new client struct to the map if it doesn't already exist.
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(am.cfg.Config.Limiter.Rps), am.cfg.Config.Limiter.Burst),
-				}
-			}
+// The rateLimit() helper checks the request against the limit for the key in the rate
+// limiter store, and sends a 429 Too Many Requests response if it isn't allowed. If the
+// store can't be reached we log the error and let the request through, as it's better
+// to serve clients without limits for a while than to stop serving them altogether.
+func (am *AppMiddleware) rateLimit(w http.ResponseWriter, r *http.Request, group, key string, limit ratelimit.Limit) bool {
+	result, err := am.cfg.RateLimiter.Allow(r.Context(), key, limit)
+	if err != nil {
+		am.cfg.Logger.ErrorContext(r.Context(), "rate limiter unavailable", "error", err.Error())
+		return true
+	}
 
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
+	// Tell the client about its quota on every response, using the headers from the
+	// IETF RateLimit header fields draft. The reset is the number of seconds until the
+	// full burst is available again. When both limiters run, the headers describe the
+	// route group limit, which is the one the client is most likely to reach.
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds()))))
+
+	if !result.Allowed {
+		metrics.RateLimitRejections.WithLabelValues(group).Inc()
+		am.cfg.Errors.RateLimitExceededResponse(w, r, result.RetryAfter)
+		return false
+	}
 
-			// Call the Allow() method on the rate limiter for the current IP address. If
-			// the request isn't allowed, unlock the mutex and send a 429 Too Many Requests
-			// response, just like before.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				am.cfg.Errors.RateLimitExceededResponse(w, r)
-				return
-			}
+	return true
+}
 
-			// Very importantly, unlock the mutex before calling the next handler in the
-			// chain. Notice that we DON'T use defer to unlock the mutex, as that would mean
-			// that the mutex isn't unlocked until all the handlers downstream of this
-			// middleware have also returned.
-			mu.Unlock()
+// The rateLimitGroup() helper returns the name of the route group the request belongs
+// to, along with the limit for that group.
+func (am *AppMiddleware) rateLimitGroup(r *http.Request) (string, ratelimit.Limit) {
+	cfg := am.cfg.Config.Limiter
+
+	for _, prefix := range cfg.AuthPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return "auth", ratelimit.Limit{Rate: cfg.AuthRps, Burst: cfg.AuthBurst}
 		}
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "read", ratelimit.Limit{Rate: cfg.ReadRps, Burst: cfg.ReadBurst}
+	default:
+		return "default", ratelimit.Limit{Rate: cfg.Rps, Burst: cfg.Burst}
+	}
+}
+
+// The rateLimitKey() helper returns the key identifying the client making the request.
+// API keys get their own budget, separate from the user who created them, so that a
+// busy integration can't lock its owner out.
+func (am *AppMiddleware) rateLimitKey(r *http.Request) string {
+	if am.cfg.Config.Limiter.KeyBy == "user" {
+		if key := ContextGetAPIKey(r); key != nil {
+			return fmt.Sprintf("apikey:%d", key.ID)
+		}
+
+		if user := ContextGetUser(r); !user.IsAnonymous() {
+			return fmt.Sprintf("user:%d", user.ID)
+		}
+	}
+
+	return "ip:" + ContextGetClientIP(r)
 }
 
 func (am *AppMiddleware) Authenticate(next http.Handler) http.Handler {
@@ -140,27 +253,42 @@ func (am *AppMiddleware) Authenticate(next http.Handler) http.Handler {
 		// caches that the response may vary based on the value of the Authorization
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
-		// Retrieve the value of the Authorization header from the request. This will
-		// return the empty string "" if there is no such header found.
+		// Retrieve the value of the Authorization and X-API-Key headers from the
+		// request. These will return the empty string "" if there is no such header
+		// found.
 		authorizationHeader := r.Header.Get("Authorization")
+		apiKeyHeader := r.Header.Get("X-API-Key")
 
 		// If there is no Authorization header found, use the contextSetUser() helper
 		// that we just made to add the AnonymousUser to the request context. Then we
 		// call the next handler in the chain and return without executing any of the
 		// code below.
-		if authorizationHeader == "" {
+		if authorizationHeader == "" && apiKeyHeader == "" {
 			r = contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		// API keys can be presented either in the X-API-Key header, or in the
+		// Authorization header in the format "ApiKey <key>".
+		if apiKeyHeader != "" {
+			am.authenticateAPIKey(w, r, next, apiKeyHeader)
+			return
+		}
+
 		// Otherwise, we expect the value of the Authorization header to be in the format
 		// "Bearer <token>". We try to split this into its constituent parts, and if the
 		// header isn't in the expected format we return a 401 Unauthorized response
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			am.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			am.cfg.Errors.InvalidAuthenticationTokenResponse(w, r)
 			return
@@ -169,6 +297,39 @@ func (am *AppMiddleware) Authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
+		// Access tokens issued to third-party applications are stored separately from
+		// our own authentication tokens, and are recognisable by their prefix.
+		if data.IsOAuthToken(token) {
+			am.authenticateOAuthToken(w, r, next, token)
+			return
+		}
+
+		// If signed tokens are enabled and this looks like one, verify it locally and
+		// build the user from its claims, without touching the database at all. This
+		// means that a signed token stays valid, with the permissions it was issued
+		// with, until it expires, even if it is revoked or the user's roles change in
+		// the meantime. That is why its lifetime is capped at MaxSignedAccessTokenTTL.
+		if am.cfg.Signer != nil && auth.IsSigned(token) {
+			claims, err := am.cfg.Signer.Verify(token)
+			if err != nil {
+				am.cfg.Errors.InvalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			userID, err := claims.UserID()
+			if err != nil {
+				am.cfg.Errors.InvalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+			r = contextSetToken(r, token)
+			r = contextSetPermissions(r, claims.Permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -184,7 +345,7 @@ func (am *AppMiddleware) Authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := am.cfg.Models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := am.cfg.Models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -195,22 +356,88 @@ func (am *AppMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Record when the token was last used, so that it can be shown to the user in
+		// their list of sessions.
+		err = am.cfg.Models.Tokens.Touch(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			am.cfg.Errors.ServerErrorResponse(w, r, err)
+			return
+		}
+
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
+		// context, and keep hold of the token so that it can be revoked later.
 		r = contextSetUser(r, user)
+		r = contextSetToken(r, token)
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateAPIKey() helper looks up the user owning an API key and adds both of
+// them to the request context before calling the next handler in the chain.
+func (am *AppMiddleware) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, keyPlaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		am.cfg.Errors.InvalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, user, err := am.cfg.Models.APIKeys.GetForKey(r.Context(), keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			am.cfg.Errors.InvalidAPIKeyResponse(w, r)
+		default:
+			am.cfg.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = am.cfg.Models.APIKeys.Touch(r.Context(), key.ID)
+	if err != nil {
+		am.cfg.Errors.ServerErrorResponse(w, r, err)
+		return
+	}
+
+	// The key's permissions are only enforced by RequirePermission(), so the account
+	// management routes, which don't need a permission, are closed to API keys with
+	// RequireFirstParty().
+	r = contextSetUser(r, user)
+	r = contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateOAuthToken() helper looks up the user that an OAuth access token acts
+// on behalf of and adds both of them to the request context before calling the next
+// handler in the chain.
+func (am *AppMiddleware) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, next http.Handler, tokenPlaintext string) {
+	token, user, err := am.cfg.Models.OAuthTokens.GetForToken(r.Context(), tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			am.cfg.Errors.InvalidAuthenticationTokenResponse(w, r)
+		default:
+			am.cfg.Errors.ServerErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = contextSetUser(r, user)
+	r = contextSetOAuthToken(r, token)
+
+	next.ServeHTTP(w, r)
+}
+
 // Create a new RequireAuthenticatedUser() middleware to check that a user is not
 // anonymous.
 func (am *AppMiddleware) RequireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Use the contextGetUser() helper that we made earlier to retrieve the user
+		// Use the ContextGetUser() helper that we made earlier to retrieve the user
 		// information from the request context.
-		user := contextGetUser(r)
+		user := ContextGetUser(r)
 
 		// If the user is anonymous, then call the authenticationRequiredResponse() to
 		// inform the client that they should authenticate before trying again.
@@ -227,9 +454,9 @@ func (am *AppMiddleware) RequireAuthenticatedUser(next http.HandlerFunc) http.Ha
 func (am *AppMiddleware) RequireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	// Rather than returning this http.HandlerFunc we assign it to the variable fn.
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Use the contextGetUser() helper that we made earlier to retrieve the user
+		// Use the ContextGetUser() helper that we made earlier to retrieve the user
 		// information from the request context.
-		user := contextGetUser(r)
+		user := ContextGetUser(r)
 
 		// If the user is not activated, use the inactiveAccountResponse() helper to
 		// inform them that they need to activate their account.
@@ -245,15 +472,68 @@ func (am *AppMiddleware) RequireActivatedUser(next http.HandlerFunc) http.Handle
 	return am.RequireAuthenticatedUser(fn)
 }
 
+// The RequireFirstParty() middleware rejects requests made with a delegated credential:
+// an API key, or an access token issued to a third-party application. Those credentials
+// are limited to their scopes by RequirePermission(), but the routes which manage the
+// account itself (sessions, two-factor authentication, API keys, OAuth clients and
+// consents, invitations) aren't guarded by a permission, so they must only be reachable
+// by the user themselves. Anonymous requests are let through, so that it can guard the
+// routes used to sign in.
+func (am *AppMiddleware) RequireFirstParty(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ContextIsDelegated(r) {
+			am.cfg.Errors.NotPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Checks that a user is authenticated, and that the request wasn't made with a
+// delegated credential.
+func (am *AppMiddleware) RequireFirstPartyUser(next http.HandlerFunc) http.HandlerFunc {
+	return am.RequireAuthenticatedUser(am.RequireFirstParty(next))
+}
+
+// The EffectivePermissions() method returns the permissions that the request can use:
+// those of the user making it, narrowed down to the scope of the credential it was made
+// with.
+func (am *AppMiddleware) EffectivePermissions(r *http.Request) (data.Permissions, error) {
+	user := ContextGetUser(r)
+
+	// Get the slice of permissions for the user, using the ones embedded in a signed
+	// token if there are any and falling back to the database otherwise.
+	permissions, ok := contextGetPermissions(r)
+	if !ok {
+		var err error
+		permissions, err = am.cfg.Models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the request was made with an API key, it can only use the permissions which
+	// were granted to the key and which its owner still has.
+	if key := ContextGetAPIKey(r); key != nil {
+		permissions = permissions.Intersect(key.Permissions)
+	}
+
+	// Likewise, an OAuth access token can only use the scopes that the user granted to
+	// the third-party application.
+	if token := ContextGetOAuthToken(r); token != nil {
+		permissions = permissions.Intersect(token.Scopes)
+	}
+
+	return permissions, nil
+}
+
 // Note that the first parameter for the middleware function is the permission code that
 // we require the user to have.
 func (am *AppMiddleware) RequirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := contextGetUser(r)
-
-		// Get the slice of permissions for the user.
-		permissions, err := am.cfg.Models.Permissions.GetAllForUser(user.ID)
+		// Get the permissions that the request can use.
+		permissions, err := am.EffectivePermissions(r)
 		if err != nil {
 			am.cfg.Errors.ServerErrorResponse(w, r, err)
 			return
@@ -298,6 +578,9 @@ func (am *AppMiddleware) EnableCORS(next http.Handler) http.Handler {
 					// out of the loop.
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 
+					// Let browser clients read the rate limit and request ID headers too.
+					w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID")
+
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
 					// it as a preflight request.
@@ -305,7 +588,7 @@ func (am *AppMiddleware) EnableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -321,7 +604,10 @@ func (am *AppMiddleware) EnableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (am *AppMiddleware) Metrics(next http.Handler) http.Handler {
+// The Metrics() middleware records the metrics for each request, both in expvar and in
+// Prometheus. It takes the router so that the Prometheus metrics can be labelled with
+// the route pattern that the request matched.
+func (am *AppMiddleware) Metrics(router *httprouter.Router, next http.Handler) http.Handler {
 	// Initialize the new expvar variables when the middleware chain is first built.
 	var (
 		totalRequestsReceived           = expvar.NewInt("total_requests_received")
@@ -339,6 +625,9 @@ func (am *AppMiddleware) Metrics(next http.Handler) http.Handler {
 		// Use the Add() method to increment the number of requests received by 1.
 		totalRequestsReceived.Add(1)
 
+		metrics.HTTPRequestsInFlight.Inc()
+		defer metrics.HTTPRequestsInFlight.Dec()
+
 		// Create a new metricsResponseWriter, which wraps the original
 		// http.ResponseWriter value that the metrics middleware received.
 		mw := newMetricsResponseWriter(w)
@@ -362,14 +651,94 @@ func (am *AppMiddleware) Metrics(next http.Handler) http.Handler {
 
 		// Calculate the number of microseconds since we began to process the request,
 		// then increment the total processing time by this amount.
-		duration := time.Since(start).Microseconds()
-		totalProcessingTimeMicroseconds.Add(duration)
+		duration := time.Since(start)
+		totalProcessingTimeMicroseconds.Add(duration.Microseconds())
+
+		method := metricsMethod(r.Method)
+		route := routePattern(router, r)
+
+		// Name the request span after the route, now that we know which one it matched.
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+
+		metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(mw.statusCode)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
 	})
 }
 
+// The routePattern() helper returns the httprouter route pattern that the request
+// matches, such as /v1/movies/:id, so that requests for different resources are
+// counted together. Requests which don't match any route are all grouped together as
+// "unmatched".
+//
+// To find out which segments of the path are parameters we look the path up again
+// with each segment in turn swapped for a placeholder: if the placeholder comes back as
+// the value of a parameter, that segment is the parameter. Matching on the position
+// rather than the value means that a parameter whose value happens to equal an earlier
+// segment (like /v1/movies/v1) is still put in the right place. httprouter doesn't
+// allow a parameter and a fixed segment in the same position, so a swapped segment
+// can't match a different route.
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	path, rest, suffix := r.URL.Path, "", ""
+
+	// A catch-all parameter takes up the rest of the path, including its leading slash.
+	if n := len(params); n > 0 && strings.HasPrefix(params[n-1].Value, "/") {
+		rest = params[n-1].Value
+		path = strings.TrimSuffix(path, rest)
+		suffix = "/*" + params[n-1].Key
+		params = params[:n-1]
+	}
+
+	if len(params) == 0 {
+		return path + suffix
+	}
+
+	const placeholder = "\x00"
+
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+
+		segments[i] = placeholder
+		_, probeParams, _ := router.Lookup(r.Method, strings.Join(segments, "/")+rest)
+		segments[i] = segment
+
+		for _, param := range probeParams {
+			if param.Value == placeholder {
+				segments[i] = ":" + param.Key
+				break
+			}
+		}
+	}
+
+	return strings.Join(segments, "/") + suffix
+}
+
+// The metricsMethod() helper returns the request method to use as a metrics label,
+// grouping any non-standard methods together so that clients can't create new series.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
 type metricsResponseWriter struct {
 	wrapped       http.ResponseWriter
 	statusCode    int
+	bytes         int
 	headerWritten bool
 }
 
@@ -395,7 +764,11 @@ func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
 
 func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
 	mw.headerWritten = true
-	return mw.wrapped.Write(b)
+
+	n, err := mw.wrapped.Write(b)
+	mw.bytes += n
+
+	return n, err
 }
 
 func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
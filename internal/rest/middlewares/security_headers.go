@@ -0,0 +1,147 @@
+package middlewares
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/AguilaMike/greenlight/pkg/utilities/rest/helper"
+)
+
+// The SecurityHeaders() middleware sets the headers which tell browsers how to treat our
+// responses: Strict-Transport-Security, X-Content-Type-Options and Referrer-Policy on
+// every response, Content-Security-Policy on HTML responses, and Cache-Control: no-store
+// on responses to authenticated requests, so that they aren't kept by shared caches or
+// the browser. It must run after RequestID(), as it relies on the request info to know
+// whether the request was authenticated further down the chain.
+func (am *AppMiddleware) SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := am.cfg.Config.SecurityHeaders
+
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.HSTSMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(cfg.HSTSMaxAge.Seconds())))
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		if cfg.ReferrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+
+		sw := &securityHeadersResponseWriter{
+			wrapped: w,
+			r:       r,
+			csp:     cfg.ContentSecurityPolicy,
+		}
+		defer sw.finish()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// securityHeadersResponseWriter adds the headers which depend on the response, once the
+// handler has finished setting its own headers. If the handler didn't set a content
+// type, the status code is held back until the first write, so that the content type
+// can be sniffed from the body the same way net/http does.
+type securityHeadersResponseWriter struct {
+	wrapped       http.ResponseWriter
+	r             *http.Request
+	csp           string
+	statusCode    int
+	headerWritten bool
+}
+
+func (sw *securityHeadersResponseWriter) Header() http.Header {
+	return sw.wrapped.Header()
+}
+
+func (sw *securityHeadersResponseWriter) WriteHeader(statusCode int) {
+	// Informational responses don't carry the final headers, so pass them straight on.
+	if sw.headerWritten || statusCode < 200 {
+		sw.wrapped.WriteHeader(statusCode)
+		return
+	}
+
+	if sw.wrapped.Header().Get("Content-Type") == "" && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified {
+		sw.statusCode = statusCode
+		return
+	}
+
+	sw.writeHeader(statusCode, nil)
+}
+
+func (sw *securityHeadersResponseWriter) Write(b []byte) (int, error) {
+	if !sw.headerWritten {
+		statusCode := sw.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+
+		sw.writeHeader(statusCode, b)
+	}
+
+	return sw.wrapped.Write(b)
+}
+
+func (sw *securityHeadersResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.wrapped
+}
+
+// The writeHeader() method adds the headers for the response and writes the status
+// code, using the start of the body to sniff the content type if it hasn't been set.
+func (sw *securityHeadersResponseWriter) writeHeader(statusCode int, body []byte) {
+	sw.headerWritten = true
+
+	h := sw.wrapped.Header()
+
+	contentType := h.Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+		h.Set("Content-Type", contentType)
+	}
+
+	if sw.csp != "" && isHTML(contentType) {
+		h.Set("Content-Security-Policy", sw.csp)
+	}
+
+	if h.Get("Cache-Control") == "" && sw.authenticated() {
+		h.Set("Cache-Control", "no-store")
+	}
+
+	sw.wrapped.WriteHeader(statusCode)
+}
+
+// The finish() method makes sure the headers are added even if the handler never wrote
+// a body.
+func (sw *securityHeadersResponseWriter) finish() {
+	if !sw.headerWritten {
+		statusCode := sw.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+
+		sw.writeHeader(statusCode, nil)
+	}
+}
+
+// The authenticated() method reports whether the request carried credentials, or was
+// authenticated as a user further down the chain.
+func (sw *securityHeadersResponseWriter) authenticated() bool {
+	if sw.r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	info := helper.ContextGetRequestInfo(sw.r.Context())
+	return info != nil && info.UserID != 0
+}
+
+// The isHTML() helper reports whether the content type is an HTML document.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
@@ -4,8 +4,10 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/metrics"
 	"github.com/AguilaMike/greenlight/internal/rest/handlers"
 	"github.com/AguilaMike/greenlight/internal/rest/middlewares"
 )
@@ -24,19 +26,60 @@ func GenerateRoutes(cfg *config.Application) http.Handler {
 	handlers.NewMovieHandler(cfg, middleware).SetRoutes(router)
 
 	// Create routes for the user handler.
-	handlers.NewUserHandler(cfg).SetRoutes(router)
+	handlers.NewUserHandler(cfg, middleware).SetRoutes(router)
 
 	// Create routes for the token handler.
-	handlers.NewTokenHandler(cfg).SetRoutes(router)
-
-	// Return the httprouter instance.
-	return middleware.Metrics(
-		middleware.RecoverPanic(
-			middleware.EnableCORS(
-				middleware.RateLimit(
-					middleware.Authenticate(router),
+	handlers.NewTokenHandler(cfg, middleware).SetRoutes(router)
+
+	// Create routes for the OIDC handler.
+	handlers.NewOIDCHandler(cfg, middleware).SetRoutes(router)
+
+	// Create routes for the OAuth authorization server handler.
+	handlers.NewOAuthHandler(cfg, middleware).SetRoutes(router)
+
+	// Create routes for the API key handler.
+	handlers.NewAPIKeyHandler(cfg, middleware).SetRoutes(router)
+
+	// Create routes for the invitation handler.
+	handlers.NewInvitationHandler(cfg, middleware).SetRoutes(router)
+
+	// Create routes for the role handler.
+	handlers.NewRoleHandler(cfg, middleware).SetRoutes(router)
+
+	// Return the httprouter instance. The whole chain is wrapped in an OpenTelemetry
+	// handler, which continues the trace from the traceparent header of the request (or
+	// starts a new one) and records a span for it.
+	return otelhttp.NewHandler(middleware.ClientIP(
+		middleware.RequestID(
+			middleware.SecurityHeaders(
+				middleware.AccessLog(
+					middleware.Metrics(router,
+						middleware.Compress(
+							middleware.RecoverPanic(
+								middleware.EnableCORS(
+									middleware.RateLimitIP(
+										middleware.Authenticate(
+											middleware.RateLimit(router),
+										),
+									),
+								),
+							),
+						),
+					),
 				),
 			),
 		),
-	)
+	), "http.server")
+}
+
+// GenerateMetricsRoutes() returns the handler for the metrics listener, which only
+// serves the Prometheus metrics at GET /metrics. It is kept apart from the API routes
+// so that the metrics (which reveal the routes and traffic of the application) can
+// only be scraped from inside the network.
+func GenerateMetricsRoutes() http.Handler {
+	router := httprouter.New()
+
+	router.Handler(http.MethodGet, "/metrics", metrics.Handler())
+
+	return router
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/AguilaMike/greenlight/internal/config"
+	"github.com/AguilaMike/greenlight/internal/jobs"
 	"github.com/AguilaMike/greenlight/internal/rest/routes"
 )
 
@@ -26,6 +28,42 @@ func Serve(app *config.Application) error {
 		ErrorLog:     slog.NewLogLogger(app.Logger.Handler(), slog.LevelError),
 	}
 
+	// If a metrics address has been configured, serve the metrics from a separate
+	// server listening on it. We open the listener straight away, so that a bad address
+	// stops the application from starting rather than going unnoticed.
+	var metricsSrv *http.Server
+	if app.Config.Metrics.Addr != "" {
+		metricsSrv = &http.Server{
+			Addr:         app.Config.Metrics.Addr,
+			Handler:      routes.GenerateMetricsRoutes(),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			ErrorLog:     slog.NewLogLogger(app.Logger.Handler(), slog.LevelError),
+		}
+
+		ln, err := net.Listen("tcp", metricsSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			app.Logger.Info("starting metrics server", "addr", metricsSrv.Addr)
+
+			err := metricsSrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.Logger.Error("metrics server failed", "error", err.Error())
+			}
+		}()
+	}
+
+	// Create a context for the background jobs, which is cancelled when the server
+	// starts shutting down so that they stop before we wait on the WaitGroup.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	jobs.StartTokenCleanup(jobsCtx, app)
+
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
@@ -60,6 +98,18 @@ func Serve(app *config.Application) error {
 			shutdownError <- err
 		}
 
+		// Stop the metrics server too. It has no background work to wait for, so any
+		// error is just logged.
+		if metricsSrv != nil {
+			err := metricsSrv.Shutdown(ctx)
+			if err != nil {
+				app.Logger.Error("stopping metrics server failed", "error", err.Error())
+			}
+		}
+
+		// Stop the background jobs.
+		stopJobs()
+
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
 		app.Logger.Info("completing background tasks", "addr", srv.Addr)
@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Define the parameters of the codes we generate. These are the defaults from RFC 6238
+// and the only ones that every authenticator app supports, so they aren't configurable.
+const (
+	digits = 6
+	period = 30 * time.Second
+	skew   = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret() returns a new random 160-bit secret, base-32-encoded so that it can
+// be typed into an authenticator app by hand if the user can't scan the QR code.
+func GenerateSecret() (string, error) {
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(randomBytes), nil
+}
+
+// ProvisioningURI() returns the otpauth:// URI for the secret, which authenticator apps
+// can read (usually from a QR code) to set up the account.
+func ProvisioningURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(int(period.Seconds())))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// Validate() checks a code against the secret at the given time. To allow for clock
+// drift between the server and the user's device, the codes for the previous and next
+// time steps are accepted too. If the code is valid, Validate() also returns the time
+// step it belongs to, so that the caller can make sure each code is only used once.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	if len(code) != digits {
+		return 0, false
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	counter := t.Unix() / int64(period.Seconds())
+
+	for i := int64(-skew); i <= skew; i++ {
+		expected := generateCode(key, uint64(counter+i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + i, true
+		}
+	}
+
+	return 0, false
+}
+
+// generateCode() implements the HOTP algorithm from RFC 4226 for a single counter value.
+func generateCode(key []byte, counter uint64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	// Use dynamic truncation to pick 4 bytes from the HMAC, based on the low-order
+	// nibble of its last byte, then reduce them to the required number of digits.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Define the exporters that spans can be sent to.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Define an Options struct to hold the tracing settings.
+type Options struct {
+	// The exporter the spans are sent to: "none" disables tracing, "stdout" writes
+	// the spans to the standard output (handy for testing locally without a
+	// collector), and "otlp" sends them to an OpenTelemetry collector over HTTP.
+	Exporter string
+	// The host and port of the OTLP collector, and whether to connect to it over plain
+	// HTTP rather than HTTPS.
+	OTLPEndpoint string
+	OTLPInsecure bool
+	// The fraction of traces which are sampled. The sampled flag of an incoming
+	// traceparent header is ignored, as any client can set it; requests are sampled by
+	// their trace ID instead, which gives the same decision for the same trace.
+	SampleRatio float64
+	// The version of the application, recorded on every span.
+	ServiceVersion string
+}
+
+// Setup() configures the global OpenTelemetry tracer provider and the W3C Trace
+// Context propagator, which reads and writes the traceparent header. It returns a
+// function which flushes any pending spans and must be called before the application
+// exits.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch opts.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.OTLPEndpoint)}
+		if opts.OTLPInsecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, clientOpts...)
+	default:
+		return nil, fmt.Errorf("tracing: invalid exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("greenlight"),
+		semconv.ServiceVersion(opts.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(opts.SampleRatio),
+			sdktrace.WithRemoteParentSampled(sdktrace.TraceIDRatioBased(opts.SampleRatio)),
+			sdktrace.WithRemoteParentNotSampled(sdktrace.TraceIDRatioBased(opts.SampleRatio)),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -3,7 +3,10 @@ package helper
 import (
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type AppErrors struct {
@@ -19,14 +22,15 @@ func NewAppErrors(logger *slog.Logger, env string) *AppErrors {
 }
 
 // The logError() method is a generic helper for logging an error message along
-// with the current request method and URL as attributes in the log entry.
+// with the current request method and URL as attributes in the log entry. The request
+// ID and user ID are added from the request context by the log handler.
 func (ae *AppErrors) logError(r *http.Request, err error) {
 	var (
 		method = r.Method
 		uri    = r.URL.RequestURI()
 	)
 
-	ae.logger.Error(err.Error(), "method", method, "uri", uri)
+	ae.logger.ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri)
 }
 
 // The ErrorResponse() method is a generic helper for sending JSON-formatted error
@@ -74,6 +78,16 @@ func (app *AppErrors) InvalidAuthenticationTokenResponse(w http.ResponseWriter,
 	app.ErrorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// The InvalidAPIKeyResponse() method will be used to send a 401 Unauthorized status
+// code and JSON response to the client when an API key is unknown or expired.
+// 401 Unauthorized Response Helper Method
+func (app *AppErrors) InvalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid or expired API key"
+	app.ErrorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // The authenticationRequiredResponse() method will be used to send a 401 Unauthorized
 // status code and JSON response to the client.
 // 401 Unauthorized Response Helper Method
@@ -98,6 +112,14 @@ func (app *AppErrors) NotPermittedResponse(w http.ResponseWriter, r *http.Reques
 	app.ErrorResponse(w, r, http.StatusForbidden, message)
 }
 
+// The RegistrationClosedResponse() method will be used to send a 403 Forbidden status
+// code and JSON response to the client when open registration has been disabled.
+// 403 Forbidden Response Helper Method
+func (app *AppErrors) RegistrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration is by invitation only"
+	app.ErrorResponse(w, r, http.StatusForbidden, message)
+}
+
 // The NotFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 // 404 Not Found Response Helper Method
@@ -122,6 +144,24 @@ func (ae *AppErrors) EditConflictResponse(w http.ResponseWriter, r *http.Request
 	ae.ErrorResponse(w, r, http.StatusConflict, message)
 }
 
+// The IdempotencyKeyInUseResponse() method will be used to send a 409 Conflict status
+// code and JSON response to the client when it retries a request while the first request
+// with the same idempotency key is still being processed.
+// 409 Conflict Response Helper Method
+func (ae *AppErrors) IdempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is already being processed, please try again later"
+	ae.ErrorResponse(w, r, http.StatusConflict, message)
+}
+
+// The IdempotencyKeyReusedResponse() method will be used to send a 422 Unprocessable
+// Entity status code and JSON response to the client when it reuses an idempotency key
+// for a different request.
+// 422 Unprocessable Entity Response Helper Method
+func (ae *AppErrors) IdempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key has already been used for a different request"
+	ae.ErrorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
 // Note that the errors parameter here has the type map[string]string, which is exactly
 // the same as the errors map contained in our Validator type.
 // 422 Unprocessable Entity Response Helper Method
@@ -130,13 +170,29 @@ func (ae *AppErrors) FailedValidationResponse(w http.ResponseWriter, r *http.Req
 }
 
 // The RateLimitExceededResponse() method will be used to send a 429 Too Many Requests
-// status code and JSON response to the client.
+// status code and JSON response to the client. The Retry-After header tells the client
+// how many seconds to wait before its next request will be allowed.
 // 429 Too Many Requests Response Helper Method
-func (ae *AppErrors) RateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+func (ae *AppErrors) RateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
 	message := "rate limit exceeded"
 	ae.ErrorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// The TooManyLoginAttemptsResponse() method will be used to send a 429 Too Many
+// Requests status code and JSON response to the client when login attempts are being
+// delayed or the account has been locked out after too many failed attempts. The
+// Retry-After header tells the client how many seconds to wait.
+// 429 Too Many Requests Response Helper Method
+func (ae *AppErrors) TooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := fmt.Sprintf("too many failed login attempts, please try again in %d seconds", seconds)
+	ae.ErrorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 /****************************************************
 * 500 Internal Server Error Response Helper Methods *
 ****************************************************/
@@ -0,0 +1,69 @@
+package helper
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Define a custom requestInfoContextKey type, so that the key can't collide with the
+// context keys of any other package.
+type requestInfoContextKey struct{}
+
+// RequestInfo holds the details of a request which should be included in every log
+// entry written while handling it, including from any background work it starts. It is
+// added to the context by the RequestID middleware, and the user ID is filled in once
+// the request has been authenticated. Because it is shared by pointer, the access log
+// written on the way back up the middleware chain can see the user ID too.
+type RequestInfo struct {
+	ID     string
+	UserID int64
+}
+
+// ContextSetRequestInfo() returns a copy of the context carrying the request info.
+func ContextSetRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey{}, info)
+}
+
+// ContextGetRequestInfo() retrieves the request info from the context, returning nil
+// if there is none (for example in work that wasn't started by a request).
+func ContextGetRequestInfo(ctx context.Context) *RequestInfo {
+	info, ok := ctx.Value(requestInfoContextKey{}).(*RequestInfo)
+	if !ok {
+		return nil
+	}
+
+	return info
+}
+
+// logHandler is a slog.Handler which adds the request ID and user ID from the context
+// to each log record, before passing it on to the wrapped handler. This way, any entry
+// logged with one of the slog *Context() methods can be tied back to its request.
+type logHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler() wraps the handler so that it includes the request info in each log
+// record.
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return &logHandler{Handler: h}
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := ContextGetRequestInfo(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.ID))
+
+		if info.UserID != 0 {
+			record.AddAttrs(slog.Int64("user_id", info.UserID))
+		}
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name)}
+}
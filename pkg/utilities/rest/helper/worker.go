@@ -1,11 +1,18 @@
 package helper
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// The tracer used to record a span for each piece of background work.
+var tracer = otel.Tracer("github.com/AguilaMike/greenlight/pkg/utilities/rest/helper")
+
 type AppWorker struct {
 	env    string
 	logger *slog.Logger
@@ -20,8 +27,19 @@ func NewAppWorker(logger *slog.Logger, env string, wg *sync.WaitGroup) *AppWorke
 	}
 }
 
-// The background() helper accepts an arbitrary function as a parameter.
-func (app *AppWorker) Background(fn func()) {
+// The background() helper accepts an arbitrary function as a parameter, and runs it in
+// a background goroutine with a copy of the context. The copy keeps the values of the
+// context (such as the request info used in log entries) but not its cancellation, so
+// that work started by a request isn't cut short once the response has been sent. If the
+// context belongs to a trace, the work is recorded as an OpenTelemetry span in it.
+func (app *AppWorker) Background(ctx context.Context, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+
+	var span trace.Span
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		ctx, span = tracer.Start(ctx, "background")
+	}
+
 	// Increment the WaitGroup counter.
 	app.Wg.Add(1)
 
@@ -30,14 +48,19 @@ func (app *AppWorker) Background(fn func()) {
 		// Use defer to decrement the WaitGroup counter before the goroutine returns.
 		defer app.Wg.Done()
 
+		// End the span once the work has finished.
+		if span != nil {
+			defer span.End()
+		}
+
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Error(fmt.Sprintf("%v", err))
+				app.logger.ErrorContext(ctx, fmt.Sprintf("%v", err))
 			}
 		}()
 
 		// Execute the arbitrary function that we passed as the parameter.
-		fn()
+		fn(ctx)
 	}()
 }
@@ -0,0 +1,5 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
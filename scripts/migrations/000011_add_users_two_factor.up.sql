@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret bytea;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled bool NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    hash bytea PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL,
+    locked_until timestamp(0) with time zone
+);
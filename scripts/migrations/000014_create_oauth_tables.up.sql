@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id text PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    secret_hash bytea,
+    redirect_uris text[] NOT NULL,
+    scopes text[] NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    scopes text[] NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash bytea PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text[] NOT NULL,
+    code_challenge text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    hash bytea PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    scopes text[] NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    token_hash bytea PRIMARY KEY REFERENCES tokens ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email citext NOT NULL,
+    permissions text[] NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations (email);
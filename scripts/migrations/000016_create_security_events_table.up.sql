@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS security_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    type text NOT NULL,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS security_events_user_id_created_at_idx ON security_events (user_id, created_at);
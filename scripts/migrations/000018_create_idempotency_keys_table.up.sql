@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    owner text NOT NULL,
+    key text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    request_hash bytea NOT NULL,
+    status_code integer,
+    header jsonb,
+    body bytea,
+    PRIMARY KEY (owner, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
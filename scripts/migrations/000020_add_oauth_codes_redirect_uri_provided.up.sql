@@ -0,0 +1 @@
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS redirect_uri_provided bool NOT NULL DEFAULT true;
@@ -0,0 +1 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS fence uuid NOT NULL DEFAULT gen_random_uuid();